@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// recordMetricNames remembers which targets contributed each metric family
+// to the latest aggregation.
+func (f *Aggregator) recordMetricNames(familySources map[string][]string) {
+	f.metricNamesMu.Lock()
+	f.metricNames = familySources
+	f.metricNamesMu.Unlock()
+}
+
+type metricName struct {
+	Name    string   `json:"name"`
+	Targets []string `json:"targets"`
+}
+
+// metricNamesHandler lists the metric families seen in the latest aggregation
+// as a JSON array of names, or of names and the targets that export them when
+// called with ?targets=true.
+func metricNamesHandler(aggregator *Aggregator) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		aggregator.metricNamesMu.RLock()
+		names := make([]metricName, 0, len(aggregator.metricNames))
+		for name, targets := range aggregator.metricNames {
+			sorted := append([]string{}, targets...)
+			sort.Strings(sorted)
+			names = append(names, metricName{Name: name, Targets: sorted})
+		}
+		aggregator.metricNamesMu.RUnlock()
+
+		sort.Slice(names, func(i, j int) bool { return names[i].Name < names[j].Name })
+
+		var body interface{} = names
+		if r.URL.Query().Get("targets") != "true" {
+			plain := make([]string, len(names))
+			for i, n := range names {
+				plain[i] = n.Name
+			}
+			body = plain
+		}
+		writeJSON(rw, body)
+	}
+}
+
+type refreshStatus struct {
+	URL           string  `json:"url"`
+	Success       bool    `json:"success"`
+	StatusCode    int     `json:"status_code,omitempty"`
+	SecondsTaken  float64 `json:"seconds_taken"`
+	Families      int     `json:"families"`
+	Error         string  `json:"error,omitempty"`
+	ErrorCategory string  `json:"error_category,omitempty"`
+}
+
+// refreshHandler serves POST /api/targets/<name>/refresh, which scrapes the
+// target with that name or index right away and returns how it went. A target
+// scraped in the background has its cached result replaced, so a fix can be
+// checked without waiting for its next interval.
+func refreshHandler(config *Config, aggregator *Aggregator) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/targets/"), "/refresh")
+		target := findTarget(config.currentTargets(), name)
+		if target == nil || !strings.HasSuffix(r.URL.Path, "/refresh") {
+			http.NotFound(rw, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(rw, newRefreshStatus(aggregator.Refresh(r.Context(), target)))
+	}
+}
+
+// historyHandler serves GET /api/targets/<name>/history, the last
+// -targets.history.size scrapes of the target with that name or index, oldest
+// first.
+func historyHandler(config *Config, aggregator *Aggregator) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/targets/"), "/history")
+		target := findTarget(config.currentTargets(), name)
+		if target == nil || !strings.HasSuffix(r.URL.Path, "/history") {
+			http.NotFound(rw, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			rw.Header().Set("Allow", http.MethodGet)
+			http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(rw, aggregator.history.entries(target))
+	}
+}
+
+// targetAPIHandler routes /api/targets/<name>/... to the handler of the action.
+func targetAPIHandler(config *Config, aggregator *Aggregator) http.HandlerFunc {
+	refresh, history := refreshHandler(config, aggregator), historyHandler(config, aggregator)
+	return func(rw http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/refresh"):
+			refresh(rw, r)
+		case strings.HasSuffix(r.URL.Path, "/history"):
+			history(rw, r)
+		default:
+			http.NotFound(rw, r)
+		}
+	}
+}
+
+func newRefreshStatus(result *Result) refreshStatus {
+	status := refreshStatus{
+		URL:           result.URL,
+		Success:       result.Error == nil,
+		StatusCode:    result.StatusCode,
+		SecondsTaken:  result.SecondsTaken,
+		Families:      len(result.MetricFamily),
+		ErrorCategory: result.ErrorCategory,
+	}
+	if result.Error != nil {
+		status.Error = result.Error.Error()
+	}
+	return status
+}
+
+func writeJSON(rw http.ResponseWriter, body interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(body); err != nil {
+		log.Printf("Failed to write JSON response: %s", err.Error())
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMetricNamesHandler(t *testing.T) {
+	first, second := newFixtureServer("histogram.txt"), newFixtureServer("histogram-summary.txt")
+	defer first.Close()
+	defer second.Close()
+
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}}
+	aggregator.Aggregate([]*Target{{URL: first.URL}, {URL: second.URL}}, &bytes.Buffer{}, AggregateOptions{})
+
+	rec := httptest.NewRecorder()
+	metricNamesHandler(aggregator)(rec, httptest.NewRequest("GET", "/api/metric-names", nil))
+	if expected := `["http_request_duration_seconds","http_requests_total","rpc_duration_seconds"]`; strings.TrimSpace(rec.Body.String()) != expected {
+		t.Errorf("expected %s, got %s", expected, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	metricNamesHandler(aggregator)(rec, httptest.NewRequest("GET", "/api/metric-names?targets=true", nil))
+	if expected := `{"name":"http_requests_total","targets":["` + first.URL + `"]}`; !strings.Contains(rec.Body.String(), expected) {
+		t.Errorf("expected %s in %s", expected, rec.Body.String())
+	}
+}
+
+func TestRefreshHandler(t *testing.T) {
+	var scrapes int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(rw, "scrapes %d\n", atomic.AddInt32(&scrapes, 1))
+	}))
+	defer server.Close()
+
+	target := &Target{URL: server.URL, Name: "counter", Interval: duration(time.Hour)}
+	config := &Config{Targets: []*Target{target}}
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}}
+	aggregator.Start(config.Targets)
+	if !aggregator.WaitWarm(time.Second) {
+		t.Fatal("background scrape did not complete")
+	}
+
+	rec := httptest.NewRecorder()
+	refreshHandler(config, aggregator)(rec, httptest.NewRequest("POST", "/api/targets/counter/refresh", nil))
+	var status refreshStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Success || status.StatusCode != http.StatusOK || status.Families != 1 || status.URL != server.URL {
+		t.Errorf("unexpected refresh status %+v", status)
+	}
+	result, _ := aggregator.cachedResult(target)
+	if value := result.MetricFamily["scrapes"].Metric[0].GetUntyped().GetValue(); value != 2 {
+		t.Errorf("expected the refreshed result to be cached, got scrape %v", value)
+	}
+
+	for path, code := range map[string]int{"/api/targets/missing/refresh": http.StatusNotFound, "/api/targets/0": http.StatusNotFound} {
+		rec = httptest.NewRecorder()
+		refreshHandler(config, aggregator)(rec, httptest.NewRequest("POST", path, nil))
+		if rec.Code != code {
+			t.Errorf("expected %d for %s, got %d", code, path, rec.Code)
+		}
+	}
+	rec = httptest.NewRecorder()
+	refreshHandler(config, aggregator)(rec, httptest.NewRequest("GET", "/api/targets/0/refresh", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be refused, got %d", rec.Code)
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	defer func(size int) { *targetHistorySize = size }(*targetHistorySize)
+	*targetHistorySize = 2
+
+	var scrapes int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&scrapes, 1) == 3 {
+			http.Error(rw, "broken", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(rw, "up 1")
+	}))
+	defer server.Close()
+
+	target := &Target{URL: server.URL, Name: "flapping"}
+	config := &Config{Targets: []*Target{target}}
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}}
+	for i := 0; i < 3; i++ {
+		aggregator.Aggregate(config.Targets, &bytes.Buffer{}, AggregateOptions{})
+	}
+
+	rec := httptest.NewRecorder()
+	targetAPIHandler(config, aggregator)(rec, httptest.NewRequest("GET", "/api/targets/flapping/history", nil))
+	var history []historyEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expected the last 2 scrapes, got %+v", history)
+	}
+	if !history[0].Success || history[1].Success || history[1].StatusCode != http.StatusInternalServerError || history[1].Error == "" {
+		t.Errorf("expected a success followed by a failure, got %+v", history)
+	}
+	if history[0].Timestamp.IsZero() || history[1].Timestamp.Before(history[0].Timestamp) {
+		t.Errorf("expected ordered timestamps, got %+v", history)
+	}
+
+	for method, code := range map[string]int{"GET": http.StatusOK, "POST": http.StatusMethodNotAllowed} {
+		rec = httptest.NewRecorder()
+		targetAPIHandler(config, aggregator)(rec, httptest.NewRequest(method, "/api/targets/0/history", nil))
+		if rec.Code != code {
+			t.Errorf("expected %d for %s, got %d", code, method, rec.Code)
+		}
+	}
+	rec = httptest.NewRecorder()
+	targetAPIHandler(config, aggregator)(rec, httptest.NewRequest("GET", "/api/targets/flapping/other", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown action to be not found, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreakers stops scraping targets that keep failing. After
+// -targets.breaker.failures consecutive failures a target is skipped for
+// -targets.breaker.cooldown, after which a single scrape is let through to
+// find out whether it has recovered.
+type circuitBreakers struct {
+	mu     sync.Mutex
+	states map[*Target]*circuitState
+}
+
+type circuitState struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow reports whether target may be scraped now.
+func (c *circuitBreakers) allow(target *Target) bool {
+	if *targetBreakerFailures <= 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state, ok := c.states[target]
+	if !ok || state.failures < *targetBreakerFailures {
+		return true
+	}
+	if state.probing || time.Now().Before(state.openUntil) {
+		return false
+	}
+	state.probing = true
+	return true
+}
+
+// record updates the state of target with the outcome of a scrape.
+func (c *circuitBreakers) record(target *Target, success bool) {
+	if *targetBreakerFailures <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if success {
+		delete(c.states, target)
+		return
+	}
+	if c.states == nil {
+		c.states = make(map[*Target]*circuitState)
+	}
+	state, ok := c.states[target]
+	if !ok {
+		state = &circuitState{}
+		c.states[target] = state
+	}
+	state.failures++
+	state.probing = false
+	if state.failures >= *targetBreakerFailures {
+		state.openUntil = time.Now().Add(*targetBreakerCooldown)
+	}
+}
+
+// retarget moves the state of the targets in moved to those replacing them
+// after a reload and forgets targets that were removed.
+func (c *circuitBreakers) retarget(moved map[*Target]*Target) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	states := make(map[*Target]*circuitState, len(c.states))
+	for target, state := range c.states {
+		if replacement, ok := moved[target]; ok {
+			states[replacement] = state
+		}
+	}
+	c.states = states
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	defer func(failures int, cooldown time.Duration) {
+		*targetBreakerFailures, *targetBreakerCooldown = failures, cooldown
+	}(*targetBreakerFailures, *targetBreakerCooldown)
+	*targetBreakerFailures, *targetBreakerCooldown = 2, 50*time.Millisecond
+
+	var healthy, scrapes int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&scrapes, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			io.WriteString(rw, "<html>oops</html>\n")
+			return
+		}
+		io.WriteString(rw, "up 1\n")
+	}))
+	defer server.Close()
+
+	target := &Target{URL: server.URL}
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}}
+	resultChan := make(chan *Result, 1)
+
+	for _, expected := range []string{errorParse, errorParse, errorCircuitOpen} {
+		aggregator.fetch(context.Background(), target, resultChan)
+		if result := <-resultChan; result.ErrorCategory != expected {
+			t.Fatalf("expected scrape to fail with %s, got %q", expected, result.ErrorCategory)
+		}
+	}
+	if n := atomic.LoadInt32(&scrapes); n != 2 {
+		t.Fatalf("expected the open breaker to skip the scrape, target was scraped %d times", n)
+	}
+
+	// after the cooldown a single scrape is let through
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		aggregator.fetch(context.Background(), target, resultChan)
+		if result := <-resultChan; result.Error != nil {
+			t.Fatalf("expected scrape %d after the cooldown to succeed, got %s", i, result.Error)
+		}
+	}
+}
+
+func TestCircuitBreakerWithHealthURL(t *testing.T) {
+	defer func(failures int, cooldown time.Duration) {
+		*targetBreakerFailures, *targetBreakerCooldown = failures, cooldown
+	}(*targetBreakerFailures, *targetBreakerCooldown)
+	*targetBreakerFailures, *targetBreakerCooldown = 1, 50*time.Millisecond
+
+	var healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && atomic.LoadInt32(&healthy) == 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(rw, "up 1\n")
+	}))
+	defer server.Close()
+
+	target := &Target{URL: server.URL, HealthURL: server.URL + "/healthz"}
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}}
+	resultChan := make(chan *Result, 1)
+
+	for _, expected := range []string{errorUnhealthy, errorCircuitOpen} {
+		aggregator.fetch(context.Background(), target, resultChan)
+		if result := <-resultChan; result.ErrorCategory != expected {
+			t.Fatalf("expected scrape to fail with %s, got %q", expected, result.ErrorCategory)
+		}
+	}
+
+	// the probe after the cooldown fails its health check and opens the
+	// breaker again rather than leaving it half-open
+	time.Sleep(60 * time.Millisecond)
+	aggregator.fetch(context.Background(), target, resultChan)
+	if result := <-resultChan; result.ErrorCategory != errorUnhealthy {
+		t.Fatalf("expected the probe to fail its health check, got %q", result.ErrorCategory)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(60 * time.Millisecond)
+	aggregator.fetch(context.Background(), target, resultChan)
+	if result := <-resultChan; result.Error != nil {
+		t.Fatalf("expected the target to be scraped again once healthy, got %s", result.Error)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// compressResult returns a copy of result with its families encoded as gzip
+// compressed protobuf, which takes a fraction of the memory of the parsed
+// families. result is returned as it is if the families cannot be encoded.
+func compressResult(result *Result) *Result {
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+	encoder := expfmt.NewEncoder(writer, expfmt.FmtProtoDelim)
+	for _, mf := range result.MetricFamily {
+		if err := encoder.Encode(mf); err != nil {
+			log.Printf("Failed to compress result of %s, caching it uncompressed: %s", result.URL, err.Error())
+			return result
+		}
+	}
+	if err := writer.Close(); err != nil {
+		log.Printf("Failed to compress result of %s, caching it uncompressed: %s", result.URL, err.Error())
+		return result
+	}
+
+	compressed := *result
+	compressed.MetricFamily, compressed.compressedFamilies = nil, buf.Bytes()
+	return &compressed
+}
+
+func decompressFamilies(compressed []byte) (map[string]*io_prometheus_client.MetricFamily, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	families := make(map[string]*io_prometheus_client.MetricFamily)
+	decoder := expfmt.NewDecoder(reader, expfmt.FmtProtoDelim)
+	for {
+		mf := &io_prometheus_client.MetricFamily{}
+		if err := decoder.Decode(mf); err == io.EOF {
+			return families, nil
+		} else if err != nil {
+			return nil, err
+		}
+		families[mf.GetName()] = mf
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestCompressedCache(t *testing.T) {
+	defer func(compress bool) { *targetCacheCompress = compress }(*targetCacheCompress)
+	*targetCacheCompress = true
+
+	target := &Target{URL: "http://a/metrics", Interval: duration(1)}
+	families := mustParseLargeExposition(5, 10)
+	aggregator := &Aggregator{}
+	aggregator.storeResult(target, &Result{URL: target.URL, Target: target, MetricFamily: mustParseLargeExposition(5, 10)})
+
+	if aggregator.cache[target].compressedFamilies == nil || aggregator.cache[target].MetricFamily != nil {
+		t.Fatal("expected the result to be cached compressed")
+	}
+	result, ok := aggregator.cachedResult(target)
+	if !ok || len(result.MetricFamily) != len(families) {
+		t.Fatalf("expected %d families from the cache, got %v", len(families), result)
+	}
+	for name, mf := range families {
+		if !proto.Equal(mf, result.MetricFamily[name]) {
+			t.Errorf("expected %s to survive compression, got %v", name, result.MetricFamily[name])
+		}
+	}
+}
+
+// BenchmarkCacheMemory reports the heap used by the cached results of 100
+// targets with and without -targets.cache.compress.
+func BenchmarkCacheMemory(b *testing.B) {
+	defer func(compress bool) { *targetCacheCompress = compress }(*targetCacheCompress)
+
+	for _, compress := range []bool{false, true} {
+		*targetCacheCompress = compress
+		b.Run(fmt.Sprintf("compress=%t", compress), func(b *testing.B) {
+			var stats runtime.MemStats
+			for i := 0; i < b.N; i++ {
+				aggregator := &Aggregator{}
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				before := stats.HeapAlloc
+
+				for t := 0; t < 100; t++ {
+					target := &Target{URL: fmt.Sprintf("http://host-%d/metrics", t), Interval: duration(1)}
+					aggregator.storeResult(target, &Result{URL: target.URL, Target: target, MetricFamily: mustParseLargeExposition(20, 50)})
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				b.ReportMetric(float64(stats.HeapAlloc-before)/100, "heap-bytes/target")
+				runtime.KeepAlive(aggregator)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// targetSource discovers targets in addition to those given with -targets,
+// such as -targets.command and -targets.url.
+type targetSource interface {
+	// run discovers the targets again and reports whether they changed.
+	run() (bool, error)
+
+	// current returns the targets of the last successful run.
+	current() []string
+}
+
+// discoveredTargets keeps the targets of the last successful run of a
+// targetSource.
+type discoveredTargets struct {
+	mu   sync.Mutex
+	urls []string
+}
+
+// set validates urls and reports whether they differ from the last ones. The
+// last ones are kept if urls are invalid.
+func (d *discoveredTargets) set(urls []string) (bool, error) {
+	urls = filterEmptyStrings(urls)
+	if len(urls) == 0 {
+		return false, fmt.Errorf("no targets found")
+	}
+	for i, u := range urls {
+		u, err := withDefaultScheme(u)
+		if err != nil {
+			return false, err
+		}
+		if parsed, err := url.Parse(u); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return false, fmt.Errorf("invalid target %q", u)
+		}
+		urls[i] = u
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	changed := strings.Join(urls, "\n") != strings.Join(d.urls, "\n")
+	d.urls = urls
+	return changed, nil
+}
+
+func (d *discoveredTargets) current() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.urls
+}
+
+// targetCommand discovers targets by running -targets.command, which prints
+// one target URL per line. The URLs of the last successful run are kept when
+// the command fails.
+type targetCommand struct {
+	command string
+	timeout time.Duration
+
+	discoveredTargets
+}
+
+func (c *targetCommand) run() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "sh", "-c", c.command).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return false, fmt.Errorf("%s: %s", err.Error(), bytes.TrimSpace(exitErr.Stderr))
+		}
+		return false, err
+	}
+	lines, err := readTargetList(bytes.NewReader(out))
+	if err != nil {
+		return false, err
+	}
+	return c.set(lines)
+}
+
+// runTargetSource runs source every interval and reloads the targets when
+// they change.
+func (r *reloader) runTargetSource(source targetSource, name string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		changed, err := source.run()
+		if err != nil {
+			log.Printf("Running %s failed, keeping the previous targets: %s", name, err.Error())
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if err := r.reload(); err != nil {
+			log.Printf("Reload failed, keeping the previous targets: %s", err.Error())
+		}
+	}
+}
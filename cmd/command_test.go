@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTargetCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aggregate-exporter-command")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	list := filepath.Join(dir, "targets.txt")
+	if err := ioutil.WriteFile(list, []byte("http://a/metrics\n\nhttp://b/metrics\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	command := &targetCommand{command: "cat " + list, timeout: time.Second}
+	r := &reloader{config: &Config{}, aggregator: &Aggregator{HTTP: &http.Client{Timeout: time.Second}}, targetURLs: []string{"http://c/metrics"}, sources: []targetSource{command}}
+	if changed, err := command.run(); err != nil || !changed {
+		t.Fatalf("expected the first run to change the targets, got %v and error %v", changed, err)
+	}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(r.config.currentTargets()); n != 3 {
+		t.Errorf("expected the 2 printed targets and the fixed one, got %d", n)
+	}
+	if changed, err := command.run(); err != nil || changed {
+		t.Errorf("expected an unchanged run, got %v and error %v", changed, err)
+	}
+
+	for name, script := range map[string]string{
+		"failure":   "echo broken >&2; exit 1",
+		"no output": "true",
+		"invalid":   "echo not-a-url",
+	} {
+		command.command = script
+		if _, err := command.run(); err == nil {
+			t.Errorf("expected %s to fail", name)
+		}
+	}
+	if urls := command.current(); len(urls) != 2 || urls[0] != "http://a/metrics" || urls[1] != "http://b/metrics" {
+		t.Errorf("expected the last successful targets to be kept, got %v", urls)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// acceptEncoding is sent to targets when -targets.zstd is set. Setting it
+// stops the transport from transparently decompressing gzip, so both are
+// handled by decodeBody.
+const acceptEncoding = "zstd, gzip"
+
+// decodeBody returns a reader for the decompressed body of res and a function
+// that must be called once it has been read.
+func decodeBody(res *http.Response) (io.Reader, func(), error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return res.Body, func() {}, nil
+	case "gzip":
+		reader, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, func() { reader.Close() }, nil
+	case "zstd":
+		reader, err := zstd.NewReader(res.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, reader.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
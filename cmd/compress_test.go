@@ -0,0 +1,51 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestScrapeCompressedResponses(t *testing.T) {
+	defer func(enabled bool) { *targetZstd = enabled }(*targetZstd)
+	*targetZstd = true
+
+	exposition := mustReadAll(mustOpenFile("histogram.txt", 0))
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != acceptEncoding {
+			http.Error(rw, "unexpected Accept-Encoding", http.StatusBadRequest)
+			return
+		}
+		rw.Header().Set("Content-Encoding", r.URL.Query().Get("encoding"))
+		switch r.URL.Query().Get("encoding") {
+		case "zstd":
+			writer, _ := zstd.NewWriter(rw)
+			writer.Write([]byte(exposition))
+			writer.Close()
+		case "gzip":
+			writer := gzip.NewWriter(rw)
+			writer.Write([]byte(exposition))
+			writer.Close()
+		default:
+			rw.Write([]byte(exposition))
+		}
+	}))
+	defer server.Close()
+
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}}
+	for _, encoding := range []string{"zstd", "gzip", ""} {
+		target := &Target{URL: server.URL + "?encoding=" + encoding}
+		result := aggregator.scrape(target, target.URL)
+		if result.Error != nil {
+			t.Errorf("expected %q response to be parsed, got %s", encoding, result.Error.Error())
+			continue
+		}
+		if _, ok := result.MetricFamily["http_requests_total"]; !ok {
+			t.Errorf("expected metrics from %q response, got %v", encoding, result.MetricFamily)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// fetchesInFlightMax is the highest number of fetches that ran at once.
+var fetchesInFlightMax int64
+
+// inFlight counts the fetches running right now.
+var inFlight int64
+
+// dispatch fetches target once enough of the -targets.max.concurrency slots
+// are free for its weight. If ctx is done first, e.g. because the client went
+// away, an error result is sent without fetching.
+func (f *Aggregator) dispatch(ctx context.Context, target *Target, resultChan chan *Result) {
+	if slots := f.fetchSlots(); slots != nil {
+		weight := target.weight()
+		if weight > int64(*targetsMaxConcurrency) {
+			// A target heavier than the whole budget would never fit, so it
+			// runs alone instead.
+			weight = int64(*targetsMaxConcurrency)
+		}
+		waitStart := time.Now()
+		err := slots.Acquire(ctx, weight)
+		concurrencyWait.Observe(time.Since(waitStart).Seconds())
+		if err != nil {
+			resultChan <- &Result{
+				URL:           target.URL,
+				Target:        target,
+				Error:         fmt.Errorf("gave up waiting to scrape %s: %s", target.URL, err.Error()),
+				ErrorCategory: errorOther,
+			}
+			return
+		}
+		defer slots.Release(weight)
+	}
+	f.fetch(ctx, target, resultChan)
+}
+
+// fetchSlots returns the semaphore limiting concurrent fetches, or nil if
+// there is no limit.
+func (f *Aggregator) fetchSlots() *semaphore.Weighted {
+	if *targetsMaxConcurrency <= 0 {
+		return nil
+	}
+	f.slotsOnce.Do(func() {
+		f.slots = semaphore.NewWeighted(int64(*targetsMaxConcurrency))
+	})
+	return f.slots
+}
+
+// trackFetch records a fetch as started in the self metrics and returns a
+// function to call once it finished.
+func trackFetch() func() {
+	n := atomic.AddInt64(&inFlight, 1)
+	fetchesInFlight.Set(float64(n))
+	for {
+		max := atomic.LoadInt64(&fetchesInFlightMax)
+		if n <= max || atomic.CompareAndSwapInt64(&fetchesInFlightMax, max, n) {
+			break
+		}
+	}
+	fetchesInFlightHighWater.Set(float64(atomic.LoadInt64(&fetchesInFlightMax)))
+
+	return func() {
+		fetchesInFlight.Set(float64(atomic.AddInt64(&inFlight, -1)))
+	}
+}
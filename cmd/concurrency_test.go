@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAggregateMaxConcurrency(t *testing.T) {
+	defer func(max int) { *targetsMaxConcurrency = max }(*targetsMaxConcurrency)
+	*targetsMaxConcurrency = 2
+
+	fixture := mustReadAll(mustOpenFile("histogram.txt", 0))
+	var running, maxRunning int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(rw, fixture)
+	}))
+	defer server.Close()
+
+	targets := []*Target{}
+	for i := 0; i < 6; i++ {
+		targets = append(targets, &Target{URL: server.URL})
+	}
+	before := gatherSelfMetric(t, "ae_fetch_concurrency_wait_seconds").Metric[0].Histogram.GetSampleCount()
+	(&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate(targets, &bytes.Buffer{}, AggregateOptions{})
+
+	if max := atomic.LoadInt32(&maxRunning); max > 2 {
+		t.Errorf("expected at most 2 concurrent scrapes, got %d", max)
+	}
+	if after := gatherSelfMetric(t, "ae_fetch_concurrency_wait_seconds").Metric[0].Histogram.GetSampleCount(); after != before+6 {
+		t.Errorf("expected 6 waits to be observed, count went from %d to %d", before, after)
+	}
+	if highWater := gatherSelfMetric(t, "ae_fetches_in_flight_max").Metric[0].Gauge.GetValue(); highWater < 2 {
+		t.Errorf("expected a high water mark of at least 2, got %v", highWater)
+	}
+}
+
+func TestAggregateWeightedConcurrency(t *testing.T) {
+	defer func(max int) { *targetsMaxConcurrency = max }(*targetsMaxConcurrency)
+	*targetsMaxConcurrency = 4
+
+	var running, heavyRunning, maxRunning, overlap int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		if strings.HasPrefix(r.URL.Path, "/heavy") {
+			atomic.AddInt32(&heavyRunning, 1)
+			defer atomic.AddInt32(&heavyRunning, -1)
+		}
+		if n > 1 && atomic.LoadInt32(&heavyRunning) > 0 {
+			atomic.StoreInt32(&overlap, 1)
+		}
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(rw, "up 1\n")
+	}))
+	defer server.Close()
+
+	targets := []*Target{{URL: server.URL + "/heavy", Weight: 4}, {URL: server.URL + "/heavier", Weight: 10}}
+	for i := 0; i < 4; i++ {
+		targets = append(targets, &Target{URL: server.URL})
+	}
+	(&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate(targets, &bytes.Buffer{}, AggregateOptions{})
+
+	if atomic.LoadInt32(&overlap) != 0 {
+		t.Error("expected targets weighing the whole budget to be scraped alone")
+	}
+	if max := atomic.LoadInt32(&maxRunning); max > 4 {
+		t.Errorf("expected at most 4 concurrent scrapes, got %d", max)
+	}
+}
+
+func TestDispatchCancelled(t *testing.T) {
+	defer func(max int) { *targetsMaxConcurrency = max }(*targetsMaxConcurrency)
+	*targetsMaxConcurrency = 1
+
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}}
+	// Take the only slot so the dispatch has to wait for it.
+	aggregator.fetchSlots().Acquire(context.Background(), 1)
+	defer aggregator.fetchSlots().Release(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resultChan := make(chan *Result, 1)
+	go aggregator.dispatch(ctx, &Target{URL: "http://127.0.0.1:1/metrics"}, resultChan)
+	cancel()
+
+	select {
+	case result := <-resultChan:
+		if result.Error == nil || result.ErrorCategory != errorOther {
+			t.Errorf("expected an error result for a cancelled dispatch, got %v (%s)", result.Error, result.ErrorCategory)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a cancelled dispatch to stop waiting for a slot")
+	}
+}
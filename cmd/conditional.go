@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_model/go"
+)
+
+// conditionalCache remembers the ETag and Last-Modified validators and the
+// parsed metrics of every target's latest response, so targets that support
+// conditional requests do not send and have their metrics parsed again when
+// nothing changed.
+type conditionalCache struct {
+	mu      sync.Mutex
+	entries map[*Target]*conditionalEntry
+}
+
+type conditionalEntry struct {
+	etag         string
+	lastModified string
+	families     map[string]*io_prometheus_client.MetricFamily
+}
+
+func (c *conditionalCache) addValidators(target *Target, req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[target]
+	if !ok {
+		return
+	}
+	if entry.etag != "" {
+		req.Header.Set("If-None-Match", entry.etag)
+	}
+	if entry.lastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.lastModified)
+	}
+}
+
+// families returns a copy of the metrics of target's latest response.
+func (c *conditionalCache) families(target *Target) (map[string]*io_prometheus_client.MetricFamily, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[target]
+	if !ok {
+		return nil, false
+	}
+	return cloneMetricFamilies(entry.families), true
+}
+
+func (c *conditionalCache) store(target *Target, header http.Header, families map[string]*io_prometheus_client.MetricFamily) {
+	etag, lastModified := header.Get("ETag"), header.Get("Last-Modified")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if etag == "" && lastModified == "" {
+		delete(c.entries, target)
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[*Target]*conditionalEntry)
+	}
+	c.entries[target] = &conditionalEntry{etag: etag, lastModified: lastModified, families: cloneMetricFamilies(families)}
+}
+
+// retarget moves the validators of the targets in moved to those replacing
+// them after a reload and forgets targets that were removed.
+func (c *conditionalCache) retarget(moved map[*Target]*Target) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := make(map[*Target]*conditionalEntry, len(c.entries))
+	for target, entry := range c.entries {
+		if replacement, ok := moved[target]; ok {
+			entries[replacement] = entry
+		}
+	}
+	c.entries = entries
+}
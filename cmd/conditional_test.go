@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConditionalScrape(t *testing.T) {
+	defer func(conditional bool) { *targetsConditional = conditional }(*targetsConditional)
+	*targetsConditional = true
+
+	fixture := mustReadAll(mustOpenFile("histogram.txt", 0))
+	notModified := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Header().Set("ETag", `"v1"`)
+		io.WriteString(rw, fixture)
+	}))
+	defer server.Close()
+
+	target := &Target{URL: server.URL}
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}}
+	for i := 0; i < 3; i++ {
+		result := aggregator.scrape(target, target.URL)
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		if len(result.MetricFamily["http_requests_total"].GetMetric()) != 2 {
+			t.Fatalf("scrape %d served unexpected metrics: %v", i, result.MetricFamily)
+		}
+		// modify the result like Aggregate does to check the cached copy is not shared
+		result.MetricFamily["http_requests_total"].Metric = nil
+	}
+	if notModified != 2 {
+		t.Errorf("expected the second and third scrape to be conditional, got %d not modified responses", notModified)
+	}
+}
+
+func TestConditionalScrapeNotModifiedWithoutCache(t *testing.T) {
+	defer func(conditional bool) { *targetsConditional = conditional }(*targetsConditional)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	for _, conditional := range []bool{true, false} {
+		*targetsConditional = conditional
+		target := &Target{URL: server.URL}
+		result := (&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).scrape(target, target.URL)
+		if result.Error == nil {
+			t.Errorf("conditional=%v: expected a 304 without earlier metrics to fail the scrape, got %v", conditional, result.MetricFamily)
+		}
+	}
+}
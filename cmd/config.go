@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// Target is a single metrics page that is aggregated.
+type Target struct {
+	URL string `json:"url"`
+
+	// Name identifies the target in /targets/<name>/metrics.
+	Name string `json:"name"`
+
+	// Fallback is scraped when URL fails, e.g. the standby of an HA pair. Its
+	// metrics are still labelled with URL so the pair counts as one target.
+	Fallback string `json:"fallback"`
+
+	// HealthURL, if set, is requested before every scrape and the target is
+	// only scraped if it answers with a 2xx status. It saves scraping large
+	// responses from targets that are known to be down.
+	HealthURL string `json:"health_url"`
+
+	// Interval enables background scraping of the target. Targets without an
+	// interval are scraped whenever the aggregated metrics are requested.
+	Interval duration `json:"interval"`
+
+	// Labels are added to every metric scraped from the target.
+	Labels map[string]string `json:"labels"`
+
+	// H2C scrapes the target over cleartext HTTP/2 with prior knowledge so
+	// many scrapes can share one connection.
+	H2C bool `json:"h2c"`
+
+	// DisableKeepAlive scrapes the target with a new HTTP/1.1 connection for
+	// every request and Connection: close, for old exporters that misbehave
+	// with keep-alive connections.
+	DisableKeepAlive bool `json:"disable_keepalive"`
+
+	// SSH scrapes the target through an SSH tunnel.
+	SSH *sshTunnel `json:"ssh"`
+
+	// MinBytes is the smallest response expected from the target. Smaller
+	// responses are reported by ae_response_too_small even if they parse.
+	MinBytes int64 `json:"min_bytes"`
+
+	// Weight is how many of the -targets.max.concurrency slots a scrape of
+	// the target takes, e.g. more for targets with large responses. Defaults
+	// to 1.
+	Weight int64 `json:"weight"`
+
+	// MetricsAllow and MetricsDeny limit the metric families aggregated from
+	// the target to those matching one of MetricsAllow, if set, and none of
+	// MetricsDeny.
+	MetricsAllow []string `json:"metrics_allow"`
+	MetricsDeny  []string `json:"metrics_deny"`
+
+	metricFilter *metricNameFilter
+}
+
+// keepMetric reports whether the family called name is aggregated from the
+// target.
+func (t *Target) keepMetric(name string) bool {
+	return t == nil || t.metricFilter.keep(name)
+}
+
+// stateKey identifies the target across reloads, see movedTargets.
+func (t *Target) stateKey() string {
+	return t.Name + "\xff" + t.URL
+}
+
+func (t *Target) weight() int64 {
+	if t.Weight <= 0 {
+		return 1
+	}
+	return t.Weight
+}
+
+// labelPairs returns the target's extra labels sorted by name.
+func (t *Target) labelPairs() []*io_prometheus_client.LabelPair {
+	if t == nil || len(t.Labels) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(t.Labels))
+	for name := range t.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]*io_prometheus_client.LabelPair, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, &io_prometheus_client.LabelPair{Name: proto.String(name), Value: proto.String(t.Labels[name])})
+	}
+	return pairs
+}
+
+// loadConfig builds the targets from urls given with -targets and the
+// -config.file, which is read again on every call so it can be reloaded.
+func loadConfig(urls []string) (*fileConfig, error) {
+	config := &fileConfig{}
+	for _, url := range urls {
+		url, err := withDefaultScheme(url)
+		if err != nil {
+			return nil, err
+		}
+		config.Targets = append(config.Targets, &Target{URL: url})
+	}
+	if *configFile != "" {
+		file, err := loadConfigFile(*configFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config file: %s", err.Error())
+		}
+		config.Targets = append(config.Targets, file.Targets...)
+		config.LabelReplace = file.LabelReplace
+	}
+	for _, t := range config.Targets {
+		if t.Interval == 0 {
+			t.Interval = duration(*targetScrapeInterval)
+		}
+	}
+
+	if !*targetKeepDuplicates {
+		config.Targets = filterDuplicateTargets(config.Targets)
+	}
+
+	if len(config.Targets) < 1 {
+		return nil, errors.New("no targets configured")
+	}
+	if *targetsMax > 0 && len(config.Targets) > *targetsMax {
+		if !*targetsMaxTruncate {
+			return nil, fmt.Errorf("%d targets exceeds the limit of %d", len(config.Targets), *targetsMax)
+		}
+		log.Printf("WARNING: %d targets exceeds the limit of %d, dropped the last %d", len(config.Targets), *targetsMax, len(config.Targets)-*targetsMax)
+		config.Targets = config.Targets[:*targetsMax]
+	}
+	return config, nil
+}
+
+// fileConfig is the layout of the file given by -config.file.
+type fileConfig struct {
+	Targets []*Target `json:"targets"`
+
+	// LabelReplace rules are applied in order to every aggregated metric.
+	LabelReplace []*labelReplaceRule `json:"label_replace"`
+
+	// Templates add a target for each of their instances.
+	Templates []*targetTemplate `json:"templates"`
+}
+
+// targetTemplate describes the targets of a whole service. URL is a
+// text/template such as http://{{.Host}}:{{.Port}}/metrics that is rendered
+// with the labels of every discovered instance.
+type targetTemplate struct {
+	URL       string              `json:"url"`
+	Instances []map[string]string `json:"instances"`
+	Interval  duration            `json:"interval"`
+	Labels    map[string]string   `json:"labels"`
+}
+
+// expand returns a target for each instance of the template.
+func (t *targetTemplate) expand() ([]*Target, error) {
+	tmpl, err := template.New("url").Option("missingkey=error").Parse(t.URL)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]*Target, 0, len(t.Instances))
+	for _, instance := range t.Instances {
+		url := &strings.Builder{}
+		if err := tmpl.Execute(url, instance); err != nil {
+			return nil, err
+		}
+		targets = append(targets, &Target{URL: url.String(), Interval: t.Interval, Labels: t.Labels})
+	}
+	return targets, nil
+}
+
+func loadConfigFile(path string) (*fileConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := &fileConfig{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %s", path, err.Error())
+	}
+	for i, tmpl := range config.Templates {
+		if tmpl == nil {
+			return nil, fmt.Errorf("template %d in %s is empty", i, path)
+		}
+		targets, err := tmpl.expand()
+		if err != nil {
+			return nil, fmt.Errorf("template %d in %s is invalid: %s", i, path, err.Error())
+		}
+		config.Targets = append(config.Targets, targets...)
+	}
+	names := make(map[string]bool, len(config.Targets))
+	for i, t := range config.Targets {
+		if t == nil || t.URL == "" {
+			return nil, fmt.Errorf("target %d in %s has no url", i, path)
+		}
+		for _, u := range []*string{&t.URL, &t.Fallback, &t.HealthURL} {
+			var err error
+			if *u, err = withDefaultScheme(*u); err != nil {
+				return nil, fmt.Errorf("target %d in %s is invalid: %s", i, path, err.Error())
+			}
+		}
+		if t.Name != "" {
+			if strings.Contains(t.Name, "/") || names[t.Name] {
+				return nil, fmt.Errorf("target %s in %s has a duplicate or invalid name %q", t.URL, path, t.Name)
+			}
+			names[t.Name] = true
+		}
+		if t.H2C && (!strings.HasPrefix(t.URL, "http://") || t.Fallback != "" && !strings.HasPrefix(t.Fallback, "http://")) {
+			return nil, fmt.Errorf("target %s in %s uses h2c which needs an http:// url", t.URL, path)
+		}
+		if t.DisableKeepAlive && (t.H2C || t.SSH != nil) {
+			return nil, fmt.Errorf("target %s in %s uses disable_keepalive which cannot be combined with h2c or ssh", t.URL, path)
+		}
+		if t.SSH != nil {
+			if *targetBlockPrivate {
+				return nil, fmt.Errorf("target %s in %s uses ssh which cannot be combined with -targets.block-private, the jump host makes the connection", t.URL, path)
+			}
+			if t.H2C || !isHTTPURL(t.URL) || t.Fallback != "" && !isHTTPURL(t.Fallback) {
+				return nil, fmt.Errorf("target %s in %s uses ssh which needs an http:// or https:// url without h2c", t.URL, path)
+			}
+			if err := t.SSH.validate(); err != nil {
+				return nil, fmt.Errorf("target %s in %s is invalid: %s", t.URL, path, err.Error())
+			}
+		}
+		if t.HealthURL != "" && !isHTTPURL(t.HealthURL) {
+			return nil, fmt.Errorf("target %s in %s has a health_url that is not an http:// or https:// url", t.URL, path)
+		}
+		if t.MinBytes < 0 {
+			return nil, fmt.Errorf("target %s in %s has a negative min_bytes", t.URL, path)
+		}
+		if t.Weight < 0 {
+			return nil, fmt.Errorf("target %s in %s has a negative weight", t.URL, path)
+		}
+		filter, err := compileMetricNameFilter(t.MetricsAllow, t.MetricsDeny)
+		if err != nil {
+			return nil, fmt.Errorf("target %s in %s is invalid: %s", t.URL, path, err.Error())
+		}
+		t.metricFilter = filter
+		for name := range t.Labels {
+			if !model.LabelName(name).IsValid() || isSourceLabelName(name) {
+				return nil, fmt.Errorf("target %s in %s has invalid label name %q", t.URL, path, name)
+			}
+		}
+	}
+	for i, rule := range config.LabelReplace {
+		if rule == nil {
+			return nil, fmt.Errorf("label_replace rule %d in %s is empty", i, path)
+		}
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("label_replace rule %d in %s is invalid: %s", i, path, err.Error())
+		}
+	}
+	return config, nil
+}
+
+// withDefaultScheme prepends -targets.default-scheme to u if it has no scheme,
+// e.g. to localhost:9100/metrics.
+func withDefaultScheme(u string) (string, error) {
+	if *targetsDefaultScheme == "" || u == "" || strings.Contains(u, "://") {
+		return u, nil
+	}
+	withScheme := *targetsDefaultScheme + "://" + u
+	if parsed, err := url.Parse(withScheme); err != nil || parsed.Host == "" {
+		return "", fmt.Errorf("target %q is not a valid URL with the default scheme %s", u, *targetsDefaultScheme)
+	}
+	return withScheme, nil
+}
+
+func isHTTPURL(u string) bool {
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")
+}
+
+// duration is a time.Duration written as a string such as "15s" in the config file.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations must be strings such as \"15s\": %s", err.Error())
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "aggregate-exporter-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `{"targets": [
+		{"url": "http://a/metrics"},
+		{"url": "http://b/metrics", "interval": "15s", "labels": {"team": "payments", "env": "prod"}}
+	]}`)
+	defer os.Remove(path)
+
+	config, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := config.Targets
+	if len(targets) != 2 || targets[1].URL != "http://b/metrics" || time.Duration(targets[1].Interval) != 15*time.Second {
+		t.Fatalf("unexpected targets: %v", targets)
+	}
+
+	labels := targets[1].labelPairs()
+	if len(labels) != 2 || labels[0].GetName() != "env" || labels[1].GetName() != "team" || labels[1].GetValue() != "payments" {
+		t.Errorf("expected labels sorted by name, got %v", labels)
+	}
+	if targets[0].labelPairs() != nil {
+		t.Errorf("expected no labels for target without labels")
+	}
+}
+
+func TestLoadConfigFileTemplates(t *testing.T) {
+	path := writeConfigFile(t, `{"templates": [{
+		"url": "http://{{.Host}}:{{.Port}}/metrics",
+		"instances": [{"Host": "10.0.0.1", "Port": "9100"}, {"Host": "10.0.0.2", "Port": "9101"}],
+		"labels": {"service": "node"}
+	}]}`)
+	defer os.Remove(path)
+
+	config, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Targets) != 2 || config.Targets[0].URL != "http://10.0.0.1:9100/metrics" || config.Targets[1].URL != "http://10.0.0.2:9101/metrics" {
+		t.Fatalf("expected a target per instance, got %v", config.Targets)
+	}
+	if config.Targets[1].Labels["service"] != "node" {
+		t.Errorf("expected the template labels on its targets, got %v", config.Targets[1].Labels)
+	}
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	for _, content := range []string{
+		`{"targets": [{"interval": "15s"}]}`,
+		`{"targets": [{"url": "http://a/metrics", "interval": 15}]}`,
+		`{"targets": [{"url": "http://a/metrics", "labels": {"not-valid": "x"}}]}`,
+		`{"targets": [{"url": "http://a/metrics", "labels": {"ae_source": "x"}}]}`,
+		`{"targets": [{"address": "http://a/metrics"}]}`,
+		`{"targets": [{"url": "http://a/metrics", "fallback": "https://b/metrics", "h2c": true}]}`,
+		`{"targets": [{"url": "http://a/metrics", "ssh": {"host": "bastion:22", "key_file": "id_ed25519"}}]}`,
+		`{"targets": [{"url": "http://a/metrics", "ssh": {"host": "bastion", "user": "u", "key_file": "id_ed25519"}}]}`,
+		`{"targets": [{"url": "grpc://a/pkg.Service/Metrics", "ssh": {"host": "bastion:22", "user": "u", "key_file": "id_ed25519"}}]}`,
+		`{"targets": [{"url": "http://a/metrics", "min_bytes": -1}]}`,
+		`{"targets": [{"url": "http://a/metrics", "name": "a"}, {"url": "http://b/metrics", "name": "a"}]}`,
+		`{"targets": [{"url": "http://a/metrics", "name": "a/b"}]}`,
+		`{"templates": [{"url": "http://{{.Host}}:{{.Port}}/metrics", "instances": [{"Host": "a"}]}]}`,
+		`{"templates": [{"url": "http://{{.Host/metrics", "instances": [{"Host": "a"}]}]}`,
+		`{"targets": [], "label_replace": [{"source_label": "ae_source", "regex": "(", "target_label": "service"}]}`,
+		`{"targets": [], "label_replace": [{"source_label": "ae_source", "regex": ".*", "target_label": "not-valid"}]}`,
+	} {
+		path := writeConfigFile(t, content)
+		if _, err := loadConfigFile(path); err == nil {
+			t.Errorf("expected an error loading %s", content)
+		}
+		os.Remove(path)
+	}
+}
+
+func TestLoadTargetsMax(t *testing.T) {
+	defer func(max int, truncate bool) { *targetsMax, *targetsMaxTruncate = max, truncate }(*targetsMax, *targetsMaxTruncate)
+	*targetsMax = 2
+
+	urls := []string{"http://a/metrics", "http://b/metrics", "http://c/metrics"}
+	if _, err := loadConfig(urls); err == nil {
+		t.Error("expected an error loading more targets than -targets.max")
+	}
+
+	*targetsMaxTruncate = true
+	config, err := loadConfig(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Targets) != 2 || config.Targets[1].URL != "http://b/metrics" {
+		t.Errorf("expected the first 2 targets, got %v", config.Targets)
+	}
+}
+
+func TestLoadConfigDefaultScheme(t *testing.T) {
+	defer func(scheme, path string) { *targetsDefaultScheme, *configFile = scheme, path }(*targetsDefaultScheme, *configFile)
+	*targetsDefaultScheme = "https"
+	*configFile = writeConfigFile(t, `{"targets": [
+		{"url": "b:9100/metrics", "fallback": "c:9100/metrics", "health_url": "http://b:9100/health"}
+	]}`)
+	defer os.Remove(*configFile)
+
+	config, err := loadConfig([]string{"a:9100/metrics", "http://d/metrics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"https://a:9100/metrics", "http://d/metrics", "https://b:9100/metrics"}
+	if len(config.Targets) != len(expected) {
+		t.Fatalf("expected %d targets, got %v", len(expected), config.Targets)
+	}
+	for i, url := range expected {
+		if config.Targets[i].URL != url {
+			t.Errorf("expected target %d to be %s, got %s", i, url, config.Targets[i].URL)
+		}
+	}
+	if b := config.Targets[2]; b.Fallback != "https://c:9100/metrics" || b.HealthURL != "http://b:9100/health" {
+		t.Errorf("expected the default scheme only on the fallback without one, got %s and %s", b.Fallback, b.HealthURL)
+	}
+
+	if _, err := loadConfig([]string{"bad host/metrics"}); err == nil {
+		t.Error("expected an invalid URL with the default scheme to fail")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// redacted replaces secrets in the output of /api/config.
+const redacted = "xxxxx"
+
+// secretNames are the parts of flag and query parameter names whose values
+// are hidden by /api/config.
+var secretNames = []string{"password", "passwd", "secret", "token", "apikey", "api_key", "auth"}
+
+type effectiveConfig struct {
+	Server struct {
+		Bind string `json:"bind"`
+	} `json:"server"`
+	TimeoutMs    int                 `json:"timeout_ms"`
+	Targets      []*Target           `json:"targets"`
+	LabelReplace []*labelReplaceRule `json:"label_replace"`
+	Flags        map[string]string   `json:"flags"`
+}
+
+// configHandler serves /api/config, the targets, label_replace rules and flags
+// the process is running with, including any reload, as JSON. Passwords in
+// URLs and values of flags and query parameters that look like secrets are
+// redacted.
+func configHandler(config *Config, aggregator *Aggregator, flags *flag.FlagSet) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		effective := effectiveConfig{TimeoutMs: config.Timeout, LabelReplace: aggregator.labelReplaceRules(), Flags: map[string]string{}}
+		effective.Server.Bind = config.Server.Bind
+		for _, target := range config.currentTargets() {
+			redactedTarget := *target
+			redactedTarget.URL = redactURL(target.URL)
+			redactedTarget.Fallback = redactURL(target.Fallback)
+			redactedTarget.HealthURL = redactURL(target.HealthURL)
+			effective.Targets = append(effective.Targets, &redactedTarget)
+		}
+		flags.VisitAll(func(f *flag.Flag) {
+			value := f.Value.String()
+			if isSecretName(f.Name) && value != "" {
+				value = redacted
+			}
+			parts := strings.Split(value, ",")
+			for i := range parts {
+				parts[i] = redactURL(parts[i])
+			}
+			effective.Flags[f.Name] = strings.Join(parts, ",")
+		})
+		writeJSON(rw, effective)
+	}
+}
+
+// redactURL hides the password and secret query parameters of u. Anything
+// that is not an absolute URL is returned as it is.
+func redactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return u
+	}
+	query := parsed.Query()
+	for name := range query {
+		if isSecretName(name) {
+			query.Set(name, redacted)
+		}
+	}
+	if len(query) > 0 {
+		parsed.RawQuery = query.Encode()
+	}
+	return parsed.Redacted()
+}
+
+func isSecretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range secretNames {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
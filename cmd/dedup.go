@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/prometheus/client_model/go"
+)
+
+// dedupFamilies drops the metrics of every family in families that have the
+// same values for labels as an earlier metric of the family, so that series
+// which only differ in other labels, such as the target label when several
+// targets export the same series, are output once. Metrics are merged in the
+// order their targets were given, so the series of the first of those targets
+// is the one kept. A label a metric does not have counts as empty.
+func dedupFamilies(families map[string]*io_prometheus_client.MetricFamily, labels []string) {
+	for _, mf := range families {
+		seen := make(map[string]bool, len(mf.Metric))
+		kept := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			identity := make([]*io_prometheus_client.LabelPair, 0, len(labels))
+			for _, name := range labels {
+				if l := findLabel(m, name); l != nil {
+					identity = append(identity, l)
+				}
+			}
+			key := labelSetKey(identity)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			kept = append(kept, m)
+		}
+		mf.Metric = kept
+	}
+}
+
+// dropLabels removes labels from every metric of families for
+// -metrics.drop-labels, e.g. high cardinality labels such as request IDs.
+// Metrics of a family left with the same labels as an earlier one are
+// dropped, so the output has no duplicate series. Metrics are merged in the
+// order their targets were given, so the one kept is that of the first of the
+// targets.
+func dropLabels(families map[string]*io_prometheus_client.MetricFamily, labels []string) {
+	drop := make(map[string]bool, len(labels))
+	for _, name := range labels {
+		drop[name] = true
+	}
+	for _, mf := range families {
+		seen := make(map[string]bool, len(mf.Metric))
+		kept := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			remaining := m.Label[:0]
+			for _, l := range m.Label {
+				if !drop[l.GetName()] {
+					remaining = append(remaining, l)
+				}
+			}
+			m.Label = remaining
+
+			key := labelSetKey(m.Label)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			kept = append(kept, m)
+		}
+		mf.Metric = kept
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_model/go"
+)
+
+func TestDedupFamilies(t *testing.T) {
+	mf := labelledFamily("instance", "a", "ae_source", "http://one/metrics")
+	for _, other := range []*io_prometheus_client.MetricFamily{
+		labelledFamily("instance", "a", "ae_source", "http://two/metrics"),
+		labelledFamily("instance", "b", "ae_source", "http://two/metrics"),
+		labelledFamily("ae_source", "http://three/metrics"),
+		labelledFamily("ae_source", "http://four/metrics"),
+	} {
+		mf.Metric = append(mf.Metric, other.Metric...)
+	}
+
+	dedupFamilies(map[string]*io_prometheus_client.MetricFamily{"test": mf}, []string{"instance"})
+	if len(mf.Metric) != 3 {
+		t.Fatalf("expected 3 metrics after dedup, got %d", len(mf.Metric))
+	}
+	for i, expected := range []string{
+		"instance=a,ae_source=http://one/metrics,",
+		"instance=b,ae_source=http://two/metrics,",
+		"ae_source=http://three/metrics,",
+	} {
+		if s := labelString(mf.Metric[i]); s != expected {
+			t.Errorf("expected metric %d to be %s, got %s", i, expected, s)
+		}
+	}
+}
+
+func TestDropLabels(t *testing.T) {
+	mf := labelledFamily("pod_ip", "10.0.0.1", "instance", "a")
+	for _, other := range []*io_prometheus_client.MetricFamily{
+		labelledFamily("pod_ip", "10.0.0.2", "instance", "a"),
+		labelledFamily("pod_ip", "10.0.0.3", "instance", "b"),
+		labelledFamily("instance", "c", "request_id", "1"),
+	} {
+		mf.Metric = append(mf.Metric, other.Metric...)
+	}
+	mf.Metric[1].Gauge.Value = proto.Float64(2)
+
+	dropLabels(map[string]*io_prometheus_client.MetricFamily{"test": mf}, []string{"pod_ip", "request_id"})
+	if len(mf.Metric) != 3 {
+		t.Fatalf("expected the series left the same to be output once, got %d metrics", len(mf.Metric))
+	}
+	for i, expected := range []string{"instance=a,", "instance=b,", "instance=c,"} {
+		if s := labelString(mf.Metric[i]); s != expected {
+			t.Errorf("expected metric %d to be %s, got %s", i, expected, s)
+		}
+	}
+	if v := mf.Metric[0].Gauge.GetValue(); v != 1 {
+		t.Errorf("expected the first of the duplicates to be kept, got value %v", v)
+	}
+}
+
+func TestAggregateDedupKeepsFirstTarget(t *testing.T) {
+	defer func(labels string) { *outputDedupLabels = labels }(*outputDedupLabels)
+	*outputDedupLabels = "instance"
+
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(rw, "requests{instance=\"a\"} 1\n")
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "requests{instance=\"a\"} 2\n")
+	}))
+	defer fast.Close()
+
+	output := &bytes.Buffer{}
+	targets := []*Target{{URL: slow.URL}, {URL: fast.URL}}
+	if err := (&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate(targets, output, AggregateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("requests{instance=\"a\",ae_source=%q} 1\n", slow.URL); !strings.Contains(output.String(), expected) {
+		t.Errorf("expected the series of the target given first to be kept, got:\n%s", output.String())
+	}
+}
+
+func TestAggregateDropLabelsKeepsFirstTarget(t *testing.T) {
+	defer func(labels string, enabled bool) {
+		*metricsDropLabels = labels
+		*targetLabelsEnabled = enabled
+	}(*metricsDropLabels, *targetLabelsEnabled)
+	*metricsDropLabels = "pod_ip"
+	*targetLabelsEnabled = false
+
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(rw, "replicas{pod_ip=\"10.0.0.1\"} 1\n")
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "replicas{pod_ip=\"10.0.0.2\"} 2\n")
+	}))
+	defer fast.Close()
+
+	output := &bytes.Buffer{}
+	targets := []*Target{{URL: slow.URL}, {URL: fast.URL}}
+	if err := (&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate(targets, output, AggregateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), "replicas 1\n") || strings.Contains(output.String(), "replicas 2\n") {
+		t.Errorf("expected only the series of the target given first to be kept, got:\n%s", output.String())
+	}
+}
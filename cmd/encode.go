@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// encodeMetricFamilies writes families to output sorted by name. With more
+// than one -output.encode.workers the families are split into that many
+// groups which are encoded into separate buffers at the same time, trading
+// memory for latency on large aggregations.
+func encodeMetricFamilies(output io.Writer, families map[string]*io_prometheus_client.MetricFamily, format expfmt.Format) error {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	workers := *outputEncodeWorkers
+	if workers > len(names) {
+		workers = len(names)
+	}
+	if workers <= 1 {
+		if err := encodeNamedFamilies(output, names, families, format); err != nil {
+			return err
+		}
+		return closeEncoding(output, format)
+	}
+
+	buffers := make([]bytes.Buffer, workers)
+	errs := make([]error, workers)
+	groupSize := (len(names) + workers - 1) / workers
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		start, end := i*groupSize, (i+1)*groupSize
+		if start >= len(names) {
+			break
+		}
+		if end > len(names) {
+			end = len(names)
+		}
+		wg.Add(1)
+		go func(i int, group []string) {
+			defer wg.Done()
+			errs[i] = encodeNamedFamilies(&buffers[i], group, families, format)
+		}(i, names[start:end])
+	}
+	wg.Wait()
+
+	for i := range buffers {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		if _, err := buffers[i].WriteTo(output); err != nil {
+			return err
+		}
+	}
+	return closeEncoding(output, format)
+}
+
+// encodeWithFallback is encodeMetricFamilies encoding families as text if
+// encoding them as OpenMetrics fails with -output.encode.fallback, e.g. on a
+// family that is valid in the text format but not in OpenMetrics, rather than
+// writing a broken response. The OpenMetrics output is buffered so nothing of
+// it has been written when that happens, and fellBack is called before the
+// text is written.
+func encodeWithFallback(output io.Writer, families map[string]*io_prometheus_client.MetricFamily, format expfmt.Format, fellBack func()) error {
+	if format != expfmt.FmtOpenMetrics || !*outputEncodeFallback {
+		return encodeMetricFamilies(output, families, format)
+	}
+	buf := &bytes.Buffer{}
+	err := encodeMetricFamilies(buf, families, format)
+	if err == nil {
+		_, err = buf.WriteTo(output)
+		return err
+	}
+	log.Printf("Encoding as OpenMetrics failed, encoding the output as text instead: %s", err.Error())
+	if fellBack != nil {
+		fellBack()
+	}
+	return encodeMetricFamilies(output, families, expfmt.FmtText)
+}
+
+func encodeNamedFamilies(output io.Writer, names []string, families map[string]*io_prometheus_client.MetricFamily, format expfmt.Format) error {
+	encoder := expfmt.NewEncoder(output, format)
+	for _, name := range names {
+		mf := families[name]
+		if len(mf.Metric) == 0 {
+			if err := encodeEmptyFamily(output, encoder, mf, format); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := encoder.Encode(mf); err != nil {
+			return fmt.Errorf("failed to encode %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// encodeEmptyFamily writes only the HELP and TYPE lines of a family without
+// samples when -output.empty.families is set and nothing otherwise. The text
+// encoder refuses such families so the lines are written like it would.
+func encodeEmptyFamily(output io.Writer, encoder expfmt.Encoder, mf *io_prometheus_client.MetricFamily, format expfmt.Format) error {
+	if !*outputEmptyFamilies {
+		return nil
+	}
+	if format != expfmt.FmtText {
+		return encoder.Encode(mf)
+	}
+	if mf.Help != nil {
+		if _, err := fmt.Fprintf(output, "# HELP %s %s\n", mf.GetName(), helpEscaper.Replace(mf.GetHelp())); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(output, "# TYPE %s %s\n", mf.GetName(), strings.ToLower(mf.GetType().String()))
+	return err
+}
+
+var helpEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`)
+
+// closeEncoding writes whatever format needs after the last family, such as
+// the "# EOF" line of OpenMetrics. It is written once for the whole output
+// rather than by each encoder so concurrently encoded groups can be joined.
+func closeEncoding(output io.Writer, format expfmt.Format) error {
+	if closer, ok := expfmt.NewEncoder(output, format).(expfmt.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// writeStatsComments writes a block of comments summarizing the aggregation
+// started at startTime for -output.stats, which parsers ignore but help when
+// reading the output by hand.
+func writeStatsComments(output io.Writer, results []*Result, groups []*outputGroup, startTime time.Time) error {
+	failed, series := 0, 0
+	for _, result := range results {
+		if result.Error != nil {
+			failed++
+		}
+	}
+	for _, group := range groups {
+		for _, mf := range group.families {
+			series += len(mf.Metric)
+		}
+	}
+	_, err := fmt.Fprintf(output, "# aggregation stats\n# targets: %d\n# succeeded: %d\n# failed: %d\n# duration_seconds: %.3f\n# series: %d\n",
+		len(results), len(results)-failed, failed, time.Since(startTime).Seconds(), series)
+	return err
+}
+
+// outputFormat returns the exposition format selected by name, one of "text",
+// "openmetrics" or "protobuf" for length-delimited MetricFamily messages.
+func outputFormat(name string) (expfmt.Format, error) {
+	switch name {
+	case "text":
+		return expfmt.FmtText, nil
+	case "openmetrics":
+		return expfmt.FmtOpenMetrics, nil
+	case "protobuf":
+		return expfmt.FmtProtoDelim, nil
+	}
+	return "", fmt.Errorf("unknown output format %q", name)
+}
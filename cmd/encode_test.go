@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func mustParseLargeExposition(families, series int) map[string]*io_prometheus_client.MetricFamily {
+	parsed, err := getMetricFamilies(bytes.NewReader(largeExposition(families, series)))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+func TestEncodeMetricFamiliesConcurrently(t *testing.T) {
+	defer func(workers int) { *outputEncodeWorkers = workers }(*outputEncodeWorkers)
+	families := mustParseLargeExposition(25, 3)
+
+	*outputEncodeWorkers = 1
+	serial := &bytes.Buffer{}
+	if err := encodeMetricFamilies(serial, families, expfmt.FmtText); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []int{2, 4, 7, 100} {
+		*outputEncodeWorkers = workers
+		concurrent := &bytes.Buffer{}
+		if err := encodeMetricFamilies(concurrent, families, expfmt.FmtText); err != nil {
+			t.Fatal(err)
+		}
+		if concurrent.String() != serial.String() {
+			t.Errorf("output with %d workers differs from serial output", workers)
+		}
+	}
+}
+
+// BenchmarkEncodeMetricFamilies compares worker counts. The workers can only
+// help with more than one CPU, e.g. go test -bench EncodeMetricFamilies -cpu 1,4
+// on a machine with at least 4 cores.
+func BenchmarkEncodeMetricFamilies(b *testing.B) {
+	defer func(workers int) { *outputEncodeWorkers = workers }(*outputEncodeWorkers)
+	families := mustParseLargeExposition(500, 100)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			*outputEncodeWorkers = workers
+			for i := 0; i < b.N; i++ {
+				if err := encodeMetricFamilies(&bytes.Buffer{}, families, expfmt.FmtText); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeEmptyFamilies(t *testing.T) {
+	defer func(enabled bool) { *outputEmptyFamilies = enabled }(*outputEmptyFamilies)
+	families := map[string]*io_prometheus_client.MetricFamily{
+		"dropped_total": {Name: proto.String("dropped_total"), Help: proto.String("Line one\nline two"), Type: io_prometheus_client.MetricType_COUNTER.Enum()},
+		"kept":          labelledFamily("a", "b"),
+	}
+	families["kept"].Name = proto.String("kept")
+	families["kept"].Type = io_prometheus_client.MetricType_GAUGE.Enum()
+
+	for _, c := range []struct {
+		enabled  bool
+		format   expfmt.Format
+		expected string
+	}{
+		{false, expfmt.FmtText, "# TYPE kept gauge\nkept{a=\"b\"} 1\n"},
+		{true, expfmt.FmtText, "# HELP dropped_total Line one\\nline two\n# TYPE dropped_total counter\n# TYPE kept gauge\nkept{a=\"b\"} 1\n"},
+		{true, expfmt.FmtOpenMetrics, "# HELP dropped Line one\\nline two\n# TYPE dropped counter\n# TYPE kept gauge\nkept{a=\"b\"} 1.0\n# EOF\n"},
+	} {
+		*outputEmptyFamilies = c.enabled
+		output := &bytes.Buffer{}
+		if err := encodeMetricFamilies(output, families, c.format); err != nil {
+			t.Fatal(err)
+		}
+		if output.String() != c.expected {
+			t.Errorf("expected with empty families %v in %s:\n%s\ngot:\n%s", c.enabled, c.format, c.expected, output.String())
+		}
+	}
+}
+
+func TestAggregateEmptyFamilies(t *testing.T) {
+	defer func(enabled bool, limit int) { *outputEmptyFamilies, *targetLabelLimit = enabled, limit }(*outputEmptyFamilies, *targetLabelLimit)
+	*outputEmptyFamilies, *targetLabelLimit = true, 1
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "# HELP queue_depth Jobs waiting.\n# TYPE queue_depth gauge\nqueue_depth{queue=\"a\"} 3\n")
+	}))
+	defer server.Close()
+
+	output := &bytes.Buffer{}
+	if err := (&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate([]*Target{{URL: server.URL}}, output, AggregateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "# HELP queue_depth Jobs waiting.\n# TYPE queue_depth gauge\n"; output.String() != expected {
+		t.Errorf("expected only the metadata of the dropped family, got:\n%s", output.String())
+	}
+}
+
+func TestAggregateStatsComments(t *testing.T) {
+	defer func(enabled bool) { *outputStats = enabled }(*outputStats)
+	*outputStats = true
+
+	server := newFixtureServer("histogram.txt")
+	defer server.Close()
+
+	output := &bytes.Buffer{}
+	targets := []*Target{{URL: server.URL}, {URL: "http://127.0.0.1:1/metrics"}}
+	if err := (&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate(targets, output, AggregateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"# aggregation stats\n# targets: 2\n# succeeded: 1\n# failed: 1\n# duration_seconds: ", "\n# series: 2\n"} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("expected the output to contain %q, got:\n%s", expected, output.String())
+		}
+	}
+	if _, err := getMetricFamilies(output); err != nil {
+		t.Errorf("expected the stats to be ignored by the parser, got %s", err.Error())
+	}
+}
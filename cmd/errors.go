@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Categories of failed scrapes, see classifyError.
+const (
+	errorTimeout           = "timeout"
+	errorConnectionRefused = "connection_refused"
+	errorDNS               = "dns"
+	errorTLS               = "tls"
+	errorConnection        = "connection"
+	errorParse             = "parse"
+	errorEmpty             = "empty"
+	errorNoContent         = "no_content"
+	errorCircuitOpen       = "circuit_open"
+	errorUnhealthy         = "unhealthy"
+	errorBlocked           = "blocked"
+	errorFamilyLimit       = "family_limit"
+	errorOther             = "other"
+)
+
+// errTooManyParseFailures is returned by Aggregate when more targets than
+// -targets.max.parse.failures sent a response that could not be parsed.
+var errTooManyParseFailures = errors.New("too many targets failed to parse")
+
+// classifyError works out why a request to a target failed so that a target
+// that is timing out can be told apart from one that is down or misconfigured.
+// Errors that do not come from the network are classified as fallback.
+func classifyError(err error, fallback string) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errorTimeout
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return errorDNS
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return errorConnectionRefused
+	}
+	var certErr *x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &certErr) || errors.As(err, &hostErr) || errors.As(err, &invalidErr) {
+		return errorTLS
+	}
+	if errors.Is(err, errPrivateAddress) {
+		return errorBlocked
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return errorConnection
+	}
+	return fallback
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	for expected, err := range map[string]error{
+		errorTimeout:           &url.Error{Op: "Get", URL: "http://a/metrics", Err: context.DeadlineExceeded},
+		errorDNS:               &url.Error{Op: "Get", URL: "http://a/metrics", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "a"}}},
+		errorConnectionRefused: &url.Error{Op: "Get", URL: "http://a/metrics", Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}},
+		errorConnection:        &url.Error{Op: "Get", URL: "http://a/metrics", Err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}},
+		errorParse:             errors.New("text format parsing error in line 1"),
+	} {
+		if actual := classifyError(err, errorParse); actual != expected {
+			t.Errorf("expected %v to be classified as %s, got %s", err, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_model/go"
+)
+
+// dropZeroValues removes counter, gauge and untyped samples with a value of zero.
+func dropZeroValues(families map[string]*io_prometheus_client.MetricFamily) {
+	for name, mf := range families {
+		kept := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			if m.GetCounter().GetValue() != 0 || m.GetGauge().GetValue() != 0 || m.GetUntyped().GetValue() != 0 ||
+				m.Histogram != nil || m.Summary != nil {
+				kept = append(kept, m)
+			}
+		}
+		mf.Metric = kept
+		if len(mf.Metric) == 0 {
+			delete(families, name)
+		}
+	}
+}
+
+func ExampleAggregator_dropZeroValues() {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "queue_depth{queue=\"a\"} 0\nqueue_depth{queue=\"b\"} 3\nerrors_total 0\n")
+	}))
+	defer server.Close()
+
+	// leave out the source label as the address of the test server changes
+	defer func(enabled bool) { *targetLabelsEnabled = enabled }(*targetLabelsEnabled)
+	*targetLabelsEnabled = false
+
+	aggregator := &Aggregator{
+		HTTP:        &http.Client{Timeout: time.Second},
+		PostProcess: dropZeroValues,
+	}
+	if err := aggregator.Aggregate([]*Target{{URL: server.URL}}, os.Stdout, AggregateOptions{}); err != nil {
+		fmt.Println(err)
+	}
+	// Output:
+	// # TYPE queue_depth untyped
+	// queue_depth{queue="b"} 3
+}
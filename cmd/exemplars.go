@@ -0,0 +1,56 @@
+package main
+
+import (
+	"unicode/utf8"
+
+	"github.com/prometheus/client_model/go"
+)
+
+// maxExemplarRunes is the OpenMetrics limit on the combined length of the
+// names and values of the labels of an exemplar.
+const maxExemplarRunes = 128
+
+// addSourceExemplars adds the source labels of the target at source to the
+// exemplars the target exposed on the counters and histogram buckets of mf,
+// the only samples OpenMetrics allows exemplars on, for -output.exemplars.
+// Exemplars are never made up since the value of an observation is not known
+// from its counter or bucket, and one is left as it is if the labels would
+// exceed the OpenMetrics limit.
+func addSourceExemplars(mf *io_prometheus_client.MetricFamily, source string) {
+	labels := sourceLabels(source)
+	for _, m := range mf.Metric {
+		switch mf.GetType() {
+		case io_prometheus_client.MetricType_COUNTER:
+			if m.Counter != nil {
+				labelExemplar(m.Counter.Exemplar, labels)
+			}
+		case io_prometheus_client.MetricType_HISTOGRAM:
+			for _, b := range m.GetHistogram().GetBucket() {
+				labelExemplar(b.Exemplar, labels)
+			}
+		}
+	}
+}
+
+// labelExemplar adds labels to e unless it already has a label of the same
+// name or they would take it over the OpenMetrics limit.
+func labelExemplar(e *io_prometheus_client.Exemplar, labels []*io_prometheus_client.LabelPair) {
+	if e == nil {
+		return
+	}
+	runes := 0
+	names := map[string]bool{}
+	for _, pairs := range [][]*io_prometheus_client.LabelPair{e.Label, labels} {
+		for _, l := range pairs {
+			if names[l.GetName()] {
+				return
+			}
+			names[l.GetName()] = true
+			runes += utf8.RuneCountInString(l.GetName()) + utf8.RuneCountInString(l.GetValue())
+		}
+	}
+	if runes > maxExemplarRunes {
+		return
+	}
+	e.Label = append(e.Label, labels...)
+}
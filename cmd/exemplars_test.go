@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestSourceExemplars(t *testing.T) {
+	defer func(enabled bool, mode string) { *outputExemplars, *outputAggregateMode = enabled, mode }(*outputExemplars, *outputAggregateMode)
+	*outputExemplars = true
+
+	counters, histograms := newFixtureServer("histogram.txt"), newFixtureServer("histogram-summary.txt")
+	defer counters.Close()
+	defer histograms.Close()
+	aggregate := func(format expfmt.Format) string {
+		output := &bytes.Buffer{}
+		if err := (&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate([]*Target{{URL: counters.URL}, {URL: histograms.URL}}, output, AggregateOptions{Format: format}); err != nil {
+			t.Fatal(err)
+		}
+		return output.String()
+	}
+
+	for _, mode := range []string{aggregateModeNone, aggregateModeSum} {
+		*outputAggregateMode = mode
+		if output := aggregate(expfmt.FmtOpenMetrics); strings.Contains(output, " # {") {
+			t.Errorf("expected no exemplars to be made up with mode %s:\n%s", mode, output)
+		}
+	}
+}
+
+func TestAddSourceExemplars(t *testing.T) {
+	exemplar := func(labels ...*io_prometheus_client.LabelPair) *io_prometheus_client.Exemplar {
+		return &io_prometheus_client.Exemplar{Label: labels, Value: proto.Float64(0.3)}
+	}
+	traceID := &io_prometheus_client.LabelPair{Name: proto.String("trace_id"), Value: proto.String("abc")}
+	mf := &io_prometheus_client.MetricFamily{
+		Name: proto.String("latency"),
+		Type: io_prometheus_client.MetricType_HISTOGRAM.Enum(),
+		Metric: []*io_prometheus_client.Metric{{Histogram: &io_prometheus_client.Histogram{Bucket: []*io_prometheus_client.Bucket{
+			{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(1), Exemplar: exemplar(traceID)},
+			{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(2), Exemplar: exemplar(&io_prometheus_client.LabelPair{Name: proto.String("trace_id"), Value: proto.String(strings.Repeat("a", 120))})},
+			{UpperBound: proto.Float64(2), CumulativeCount: proto.Uint64(2)},
+		}}}},
+	}
+	addSourceExemplars(mf, "http://a/metrics")
+
+	buckets := mf.Metric[0].Histogram.Bucket
+	if labels := labelString(&io_prometheus_client.Metric{Label: buckets[0].Exemplar.Label}); labels != "trace_id=abc,ae_source=http://a/metrics," {
+		t.Errorf("expected the source label to be added to the exemplar, got %s", labels)
+	}
+	if buckets[0].Exemplar.GetValue() != 0.3 {
+		t.Errorf("expected the exemplar value to be kept, got %v", buckets[0].Exemplar.GetValue())
+	}
+	if len(buckets[1].Exemplar.Label) != 1 {
+		t.Errorf("expected an exemplar at the OpenMetrics limit to be left alone, got %v", buckets[1].Exemplar.Label)
+	}
+	if buckets[2].Exemplar != nil {
+		t.Errorf("expected no exemplar to be made up, got %v", buckets[2].Exemplar)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"os"
 	"strings"
+	"time"
 )
 
 func stringFlag(set *flag.FlagSet, name string, val string, usage string) *string {
@@ -31,3 +32,9 @@ func setFromEnv(set *flag.FlagSet, name string) {
 	}
 	set.Set(name, val)
 }
+
+func durationFlag(set *flag.FlagSet, name string, val time.Duration, usage string) *time.Duration {
+	s := set.Duration(name, val, usage)
+	setFromEnv(set, name)
+	return s
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// grpcRoundTripper lets targets that only expose their metrics over gRPC be
+// scraped like any other target. A target such as
+//
+//	grpc://host:port/package.Service/Method
+//
+// (or grpcs:// for TLS) is called as a unary method with an empty request
+// message. The method must respond with a google.api.HttpBody whose data holds
+// the exposition, which is handed back to fetch as a plain HTTP response.
+type grpcRoundTripper struct {
+	scheme    string
+	transport http.RoundTripper
+}
+
+// newGRPCRoundTripper derives an HTTP/2 only transport from base. Cleartext
+// targets are spoken to with prior knowledge since gRPC does not do upgrades.
+func newGRPCRoundTripper(base *http.Transport, useTLS bool) *grpcRoundTripper {
+	transport := base.Clone()
+	transport.Protocols = new(http.Protocols)
+	if useTLS {
+		transport.Protocols.SetHTTP2(true)
+		return &grpcRoundTripper{scheme: "https", transport: transport}
+	}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return &grpcRoundTripper{scheme: "http", transport: transport}
+}
+
+func (g *grpcRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	callURL := *req.URL
+	callURL.Scheme = g.scheme
+
+	// an empty, uncompressed request message
+	call, err := http.NewRequestWithContext(req.Context(), http.MethodPost, callURL.String(), bytes.NewReader(make([]byte, 5)))
+	if err != nil {
+		return nil, err
+	}
+	call.Header.Set("Content-Type", "application/grpc")
+	call.Header.Set("TE", "trailers")
+
+	res, err := g.transport.RoundTrip(call)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	payload, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gRPC call returned HTTP status %s", res.Status)
+	}
+
+	// trailers-only responses carry the status in the headers instead
+	status := res.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = res.Header.Get("Grpc-Status")
+	}
+	if code, err := strconv.Atoi(status); err != nil || code != 0 {
+		return nil, fmt.Errorf("gRPC call failed with status %q: %s", status, res.Trailer.Get("Grpc-Message")+res.Header.Get("Grpc-Message"))
+	}
+
+	message, err := readGRPCMessage(payload)
+	if err != nil {
+		return nil, err
+	}
+	body := &httpBody{}
+	if err := proto.Unmarshal(message, body); err != nil {
+		return nil, fmt.Errorf("failed to decode gRPC response: %s", err.Error())
+	}
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         res.Proto,
+		ProtoMajor:    res.ProtoMajor,
+		ProtoMinor:    res.ProtoMinor,
+		Header:        http.Header{"Content-Type": []string{body.ContentType}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body.Data)),
+		ContentLength: int64(len(body.Data)),
+		Request:       req,
+	}, nil
+}
+
+// readGRPCMessage unwraps the single length-prefixed message of a unary response.
+func readGRPCMessage(payload []byte) ([]byte, error) {
+	if len(payload) < 5 {
+		return nil, fmt.Errorf("gRPC response did not contain a message")
+	}
+	if payload[0] != 0 {
+		return nil, fmt.Errorf("compressed gRPC responses are not supported")
+	}
+	length := binary.BigEndian.Uint32(payload[1:5])
+	if uint64(len(payload)-5) < uint64(length) {
+		return nil, fmt.Errorf("gRPC response message was truncated")
+	}
+	return payload[5 : 5+length], nil
+}
+
+// httpBody mirrors the google.api.HttpBody message.
+type httpBody struct {
+	ContentType string `protobuf:"bytes,1,opt,name=content_type,json=contentType"`
+	Data        []byte `protobuf:"bytes,2,opt,name=data"`
+}
+
+func (m *httpBody) Reset()         { *m = httpBody{} }
+func (m *httpBody) String() string { return proto.CompactTextString(m) }
+func (*httpBody) ProtoMessage()    {}
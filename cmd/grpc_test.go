@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func newGRPCTestServer(t *testing.T, status string, exposition string) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics.Exposition/Get" || r.Header.Get("Content-Type") != "application/grpc" {
+			http.Error(rw, "unexpected call", http.StatusNotFound)
+			return
+		}
+		message, err := proto.Marshal(&httpBody{ContentType: "text/plain", Data: []byte(exposition)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := make([]byte, 5, 5+len(message))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+
+		rw.Header().Set("Content-Type", "application/grpc")
+		rw.Header().Set("Trailer", "Grpc-Status")
+		rw.Write(append(frame, message...))
+		rw.Header().Set("Grpc-Status", status)
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	return server
+}
+
+func TestAggregateGRPCTarget(t *testing.T) {
+	server := newGRPCTestServer(t, "0", mustReadAll(mustOpenFile("histogram.txt", 0)))
+	defer server.Close()
+
+	target := strings.Replace(server.URL, "http://", "grpc://", 1) + "/metrics.Exposition/Get"
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second, Transport: mustNewTransport()}}
+
+	output := &bytes.Buffer{}
+	aggregator.Aggregate([]*Target{{URL: target}}, output, AggregateOptions{})
+
+	if !strings.Contains(output.String(), `http_requests_total{method="post",code="200",ae_source="`+target+`"} 1027`) {
+		t.Errorf("expected metrics from gRPC target, got:\n%s", output.String())
+	}
+}
+
+func TestAggregateGRPCTargetError(t *testing.T) {
+	server := newGRPCTestServer(t, "14", mustReadAll(mustOpenFile("histogram.txt", 0)))
+	defer server.Close()
+
+	target := strings.Replace(server.URL, "http://", "grpc://", 1) + "/metrics.Exposition/Get"
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second, Transport: mustNewTransport()}}
+
+	output := &bytes.Buffer{}
+	aggregator.Aggregate([]*Target{{URL: target}}, output, AggregateOptions{})
+
+	if output.Len() != 0 {
+		t.Errorf("expected no metrics from failing gRPC target, got:\n%s", output.String())
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// metricsHandler serves the aggregated metrics of all targets, or of a single
+// target given by its index with ?t=. The exposition format is taken from
+// ?format= and falls back to -output.format. With ?group-by-source=true the
+// metrics of each target are written separately instead of being merged,
+// ?sample= scrapes only a random fraction of the targets and ?select= only
+// those with matching labels.
+func metricsHandler(config *Config, aggregator *Aggregator) http.HandlerFunc {
+	return formatHandler(config, aggregator, "")
+}
+
+// formatHandler is metricsHandler always serving the format named fixedFormat,
+// or the format of the request if it is empty. It lets the same aggregation
+// be served in different formats on their own paths, e.g. /metrics.pb.
+func formatHandler(config *Config, aggregator *Aggregator, fixedFormat string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(rw, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		targets := config.currentTargets()
+		if *webRequireTarget && r.Form.Get("t") == "" && r.Form.Get("select") == "" {
+			http.Error(rw, "Bad Request: select targets with ?t= or ?select=", http.StatusBadRequest)
+			return
+		}
+		if t := r.Form.Get("t"); t != "" {
+			targetKey, err := strconv.Atoi(t)
+			if err != nil || targetKey < 0 || len(targets)-1 < targetKey {
+				http.Error(rw, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			targets = []*Target{targets[targetKey]}
+		}
+		if selector := r.Form.Get("select"); selector != "" {
+			if targets, err = selectTargets(targets, selector); err != nil {
+				http.Error(rw, "Bad Request", http.StatusBadRequest)
+				return
+			}
+		}
+		formatName := *outputFormatName
+		if f := r.Form.Get("format"); f != "" {
+			formatName = f
+		}
+		if fixedFormat != "" {
+			formatName = fixedFormat
+		}
+		format, err := outputFormat(formatName)
+		if err != nil {
+			http.Error(rw, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		options := AggregateOptions{Format: format, SelfMetrics: *webIncludeSelfMetrics}
+		if g := r.Form.Get("group-by-source"); g != "" {
+			if options.GroupBySource, err = strconv.ParseBool(g); err != nil || options.GroupBySource && format != expfmt.FmtText {
+				http.Error(rw, "Bad Request", http.StatusBadRequest)
+				return
+			}
+		}
+		if sample := r.Form.Get("sample"); sample != "" {
+			if options.Sample, err = strconv.ParseFloat(sample, 64); err != nil || options.Sample <= 0 || options.Sample > 1 {
+				http.Error(rw, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			options.SampleSeed = int64(*webSampleSeed)
+		}
+		if *webSummaryHeaders {
+			options.Scraped = summaryHeaders(rw.Header(), time.Now())
+		}
+		ctx, span := tracer.Start(r.Context(), "GET /metrics", trace.WithAttributes(attribute.Int("targets", len(targets))))
+		defer span.End()
+		options.Context = ctx
+
+		rw.Header().Set("Content-Type", string(format))
+		options.FellBackToText = func() { rw.Header().Set("Content-Type", string(expfmt.FmtText)) }
+		var output io.Writer = rw
+		var stall *stallWriter
+		if *webWriteStallTimeout > 0 {
+			stall = newStallWriter(rw, *webWriteStallTimeout)
+			output = stall
+		}
+		err = aggregator.Aggregate(targets, output, options)
+		// Write errors are only logged by Aggregate, so a stalled client is
+		// looked for whether or not it returned an error.
+		if stall != nil && stall.stalled {
+			log.Printf("Aborted writing metrics to %s after it accepted nothing for %s", clientIP(r), *webWriteStallTimeout)
+			return
+		}
+		if err != nil {
+			log.Printf("Aggregation failed: %s", err.Error())
+			span.SetStatus(codes.Error, err.Error())
+			if errors.Is(err, errTooManyParseFailures) {
+				rw.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+}
+
+// summaryHeaders returns a callback for AggregateOptions.Scraped that adds a
+// summary of the aggregation started at startTime to header.
+func summaryHeaders(header http.Header, startTime time.Time) func([]*Result) {
+	return func(results []*Result) {
+		failed := 0
+		for _, result := range results {
+			if result.Error != nil {
+				failed++
+			}
+		}
+		header.Set("X-Aggregate-Targets-Total", strconv.Itoa(len(results)))
+		header.Set("X-Aggregate-Targets-Failed", strconv.Itoa(failed))
+		header.Set("X-Aggregate-Duration-Ms", strconv.FormatInt(time.Since(startTime).Nanoseconds()/int64(time.Millisecond), 10))
+	}
+}
+
+// targetHandler serves /targets/<name>/metrics, the response of the target
+// with that name or index exactly as the target sent it. None of the labels,
+// limits or rewrites of the aggregation are applied, which helps debugging a
+// single target. Only line endings and a byte order mark are cleaned up with
+// -web.raw.normalize. For the same reason the target is requested directly,
+// bypassing its health check, circuit breaker and fallback, which would
+// otherwise hide the failure being debugged behind a skipped scrape or another
+// server's response.
+func targetHandler(config *Config, aggregator *Aggregator) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/targets/"), "/metrics")
+		target := findTarget(config.currentTargets(), name)
+		if target == nil || !strings.HasSuffix(r.URL.Path, "/metrics") {
+			http.NotFound(rw, r)
+			return
+		}
+
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target.URL, nil)
+		if err != nil {
+			log.Printf("Proxying %s failed: %s", target.URL, err.Error())
+			http.Error(rw, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		res, err := aggregator.clientFor(target).Do(req)
+		if err != nil {
+			log.Printf("Proxying %s failed: %s", target.URL, err.Error())
+			http.Error(rw, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		defer res.Body.Close()
+
+		if contentType := res.Header.Get("Content-Type"); contentType != "" {
+			rw.Header().Set("Content-Type", contentType)
+		}
+		var body io.Reader = res.Body
+		if *webRawNormalize {
+			body = newLineEndingReader(res.Body)
+		}
+		rw.WriteHeader(res.StatusCode)
+		if _, err := io.Copy(rw, body); err != nil {
+			log.Printf("Proxying %s failed: %s", target.URL, err.Error())
+		}
+	}
+}
+
+// selectTargets returns the targets whose labels match all of the
+// comma separated name=value pairs of selector, e.g. team=payments,env=prod.
+func selectTargets(targets []*Target, selector string) ([]*Target, error) {
+	matchers := map[string]string{}
+	for _, pair := range strings.Split(selector, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid selector %q, must be name=value pairs", selector)
+		}
+		matchers[parts[0]] = parts[1]
+	}
+
+	selected := []*Target{}
+	for _, target := range targets {
+		matches := true
+		for name, value := range matchers {
+			if actual, ok := target.Labels[name]; !ok || actual != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			selected = append(selected, target)
+		}
+	}
+	return selected, nil
+}
+
+// findTarget returns the target called name, or at index name if no target
+// has that name.
+func findTarget(targets []*Target, name string) *Target {
+	for _, target := range targets {
+		if target.Name != "" && target.Name == name {
+			return target
+		}
+	}
+	if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < len(targets) {
+		return targets[i]
+	}
+	return nil
+}
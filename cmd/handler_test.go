@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	first, second := newFixtureServer("histogram.txt"), newFixtureServer("histogram-2.txt")
+	defer first.Close()
+	defer second.Close()
+
+	config := &Config{Targets: []*Target{{URL: first.URL}, {URL: second.URL}}}
+	handler := metricsHandler(config, &Aggregator{HTTP: &http.Client{Timeout: time.Second}})
+
+	for query, expected := range map[string]int{"": 200, "?t=1": 200, "?t=2": 400, "?t=-1": 400, "?t=x": 400, "?format=openmetrics": 200, "?format=json": 400, "?group-by-source=true": 200, "?group-by-source=x": 400, "?group-by-source=true&format=openmetrics": 400, "?sample=0.5": 200, "?sample=0": 400, "?sample=1.5": 400} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/metrics"+query, nil))
+		if rec.Code != expected {
+			t.Errorf("expected %d for /metrics%s, got %d", expected, query, rec.Code)
+		}
+	}
+}
+
+func TestMetricsHandlerRequireTarget(t *testing.T) {
+	defer func(require bool) { *webRequireTarget = require }(*webRequireTarget)
+	*webRequireTarget = true
+
+	server := newFixtureServer("histogram.txt")
+	defer server.Close()
+
+	handler := metricsHandler(&Config{Targets: []*Target{{URL: server.URL, Labels: map[string]string{"team": "payments"}}}}, &Aggregator{HTTP: &http.Client{Timeout: time.Second}})
+	for query, expected := range map[string]int{"": 400, "?format=text": 400, "?t=0": 200, "?select=team=payments": 200} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/metrics"+query, nil))
+		if rec.Code != expected {
+			t.Errorf("expected %d for /metrics%s, got %d", expected, query, rec.Code)
+		}
+	}
+}
+
+func TestMetricsHandlerSummaryHeaders(t *testing.T) {
+	defer func(enabled bool) { *webSummaryHeaders = enabled }(*webSummaryHeaders)
+	*webSummaryHeaders = true
+
+	healthy, failing := newFixtureServer("histogram.txt"), newFixtureServer("histogram.txt")
+	defer healthy.Close()
+	failing.Close()
+
+	config := &Config{Targets: []*Target{{URL: healthy.URL}, {URL: failing.URL}}}
+	rec := httptest.NewRecorder()
+	metricsHandler(config, &Aggregator{HTTP: &http.Client{Timeout: time.Second}})(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if total, failed := rec.Header().Get("X-Aggregate-Targets-Total"), rec.Header().Get("X-Aggregate-Targets-Failed"); total != "2" || failed != "1" {
+		t.Errorf("expected 2 targets with 1 failed, got %s with %s failed", total, failed)
+	}
+	if rec.Header().Get("X-Aggregate-Duration-Ms") == "" {
+		t.Error("expected a duration header")
+	}
+}
+
+func TestMetricsHandlerStrict(t *testing.T) {
+	defer func(strict bool) { *targetsStrict = strict }(*targetsStrict)
+	*targetsStrict = true
+
+	healthy, failing := newFixtureServer("histogram.txt"), newFixtureServer("histogram.txt")
+	defer healthy.Close()
+	failing.Close()
+
+	config := &Config{Targets: []*Target{{URL: healthy.URL}, {URL: failing.URL}}}
+	rec := httptest.NewRecorder()
+	metricsHandler(config, &Aggregator{HTTP: &http.Client{Timeout: time.Second}})(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.Len() != 0 {
+		t.Errorf("expected an empty 503 when a target fails in strict mode, got %d with %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMetricsHandlerSelect(t *testing.T) {
+	payments, search := newFixtureServer("histogram.txt"), newFixtureServer("histogram.txt")
+	defer payments.Close()
+	defer search.Close()
+
+	config := &Config{Targets: []*Target{
+		{URL: payments.URL, Labels: map[string]string{"team": "payments", "env": "prod"}},
+		{URL: search.URL, Labels: map[string]string{"team": "search", "env": "prod"}},
+	}}
+	handler := metricsHandler(config, &Aggregator{HTTP: &http.Client{Timeout: time.Second}})
+	for selector, expected := range map[string][]string{
+		"team=payments,env=prod": {payments.URL},
+		"env=prod":               {payments.URL, search.URL},
+		"env=dev":                {},
+		"region=eu":              {},
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/metrics?select="+url.QueryEscape(selector), nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected 200 for %s, got %d", selector, rec.Code)
+		}
+		if n := strings.Count(rec.Body.String(), `ae_source="`) / 2; n != len(expected) {
+			t.Errorf("expected %d targets for %s, got:\n%s", len(expected), selector, rec.Body.String())
+		}
+		for _, u := range expected {
+			if !strings.Contains(rec.Body.String(), `ae_source="`+u+`"`) {
+				t.Errorf("expected %s to be selected by %s", u, selector)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/metrics?select=team", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid selector to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestMetricsHandlerMaxParseFailures(t *testing.T) {
+	defer func(limit int) { *targetsMaxParseFailures = limit }(*targetsMaxParseFailures)
+	*targetsMaxParseFailures = 1
+
+	healthy := newFixtureServer("histogram.txt")
+	defer healthy.Close()
+	garbage := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(rw, "not { a metric")
+	}))
+	defer garbage.Close()
+
+	for targets, expected := range map[int]int{1: http.StatusOK, 2: http.StatusBadGateway} {
+		config := &Config{Targets: []*Target{{URL: healthy.URL}}}
+		for i := 0; i < targets; i++ {
+			config.Targets = append(config.Targets, &Target{URL: fmt.Sprintf("%s/%d", garbage.URL, i)})
+		}
+		rec := httptest.NewRecorder()
+		metricsHandler(config, &Aggregator{HTTP: &http.Client{Timeout: time.Second}})(rec, httptest.NewRequest("GET", "/metrics", nil))
+		if rec.Code != expected {
+			t.Errorf("expected %d with %d unparseable targets, got %d", expected, targets, rec.Code)
+		}
+	}
+}
+
+func TestMetricsHandlerOpenMetricsSortsLabels(t *testing.T) {
+	server := newFixtureServer("histogram.txt")
+	defer server.Close()
+
+	config := &Config{Targets: []*Target{{URL: server.URL}}}
+	rec := httptest.NewRecorder()
+	metricsHandler(config, &Aggregator{HTTP: &http.Client{Timeout: time.Second}})(rec, httptest.NewRequest("GET", "/metrics?format=openmetrics", nil))
+
+	if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/openmetrics-text") {
+		t.Errorf("expected an OpenMetrics content type, got %s", contentType)
+	}
+	expected := fmt.Sprintf(`http_requests_total{ae_source="%s",code="200",method="post"} 1027`, server.URL)
+	if !strings.Contains(rec.Body.String(), expected) {
+		t.Errorf("expected labels sorted by name, got:\n%s", rec.Body.String())
+	}
+	if !strings.HasSuffix(rec.Body.String(), "# EOF\n") {
+		t.Errorf("expected output to end with # EOF, got:\n%s", rec.Body.String())
+	}
+}
+
+func TestMetricsHandlerOpenMetricsFallback(t *testing.T) {
+	defer func(fallback bool) { *outputEncodeFallback = fallback }(*outputEncodeFallback)
+	*outputEncodeFallback = true
+
+	server := newFixtureServer("histogram.txt")
+	defer server.Close()
+
+	// An exemplar with an invalid timestamp cannot be written as OpenMetrics
+	// but is left out of the text format.
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}, PostProcess: func(families map[string]*io_prometheus_client.MetricFamily) {
+		families["jobs_total"] = &io_prometheus_client.MetricFamily{
+			Name: proto.String("jobs_total"),
+			Type: io_prometheus_client.MetricType_COUNTER.Enum(),
+			Metric: []*io_prometheus_client.Metric{{Counter: &io_prometheus_client.Counter{
+				Value:    proto.Float64(1),
+				Exemplar: &io_prometheus_client.Exemplar{Value: proto.Float64(1), Timestamp: &timestamp.Timestamp{Nanos: -1}},
+			}}},
+		}
+	}}
+	config := &Config{Targets: []*Target{{URL: server.URL}}}
+	rec := httptest.NewRecorder()
+	metricsHandler(config, aggregator)(rec, httptest.NewRequest("GET", "/metrics?format=openmetrics", nil))
+
+	if contentType := rec.Header().Get("Content-Type"); contentType != string(expfmt.FmtText) {
+		t.Errorf("expected the text content type after falling back, got %s", contentType)
+	}
+	families, err := getMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatalf("expected a complete text response, got %s", err.Error())
+	}
+	if len(families["http_requests_total"].GetMetric()) != 2 || len(families["jobs_total"].GetMetric()) != 1 {
+		t.Errorf("expected all families in the text response, got %v", families)
+	}
+}
+
+func TestTargetHandler(t *testing.T) {
+	server, closed := newFixtureServer("histogram.txt"), newFixtureServer("histogram.txt")
+	defer server.Close()
+	closed.Close()
+
+	config := &Config{Targets: []*Target{{URL: closed.URL}, {URL: server.URL, Name: "api"}}}
+	handler := targetHandler(config, &Aggregator{HTTP: &http.Client{Timeout: time.Second}})
+
+	expected := mustReadAll(mustOpenFile("histogram.txt", 0))
+	for _, path := range []string{"/targets/api/metrics", "/targets/1/metrics"} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != expected {
+			t.Errorf("expected the unmodified target response for %s, got %d:\n%s", path, rec.Code, rec.Body.String())
+		}
+	}
+	for path, code := range map[string]int{"/targets/0/metrics": 502, "/targets/2/metrics": 404, "/targets/web/metrics": 404, "/targets/api": 404} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != code {
+			t.Errorf("expected %d for %s, got %d", code, path, rec.Code)
+		}
+	}
+}
+
+func TestTargetHandlerCancelled(t *testing.T) {
+	cancelled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer server.Close()
+
+	config := &Config{Targets: []*Target{{URL: server.URL}}}
+	handler := targetHandler(config, &Aggregator{HTTP: &http.Client{Timeout: 10 * time.Second}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	handler(rec, httptest.NewRequest("GET", "/targets/0/metrics", nil).WithContext(ctx))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the request to the target to be cancelled with the client's, took %s", elapsed)
+	}
+	<-cancelled
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 for a cancelled request, got %d", rec.Code)
+	}
+}
+
+func TestMetricsHandlerWriteStall(t *testing.T) {
+	defer func(timeout time.Duration) { *webWriteStallTimeout = timeout }(*webWriteStallTimeout)
+	*webWriteStallTimeout = 50 * time.Millisecond
+	logs := &syncBuffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	body := largeExposition(1000, 100)
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write(body)
+	}))
+	defer target.Close()
+
+	done := make(chan struct{})
+	handler := metricsHandler(&Config{Targets: []*Target{{URL: target.URL}}}, &Aggregator{HTTP: &http.Client{Timeout: 10 * time.Second}})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		handler(rw, r)
+		close(done)
+	}))
+	defer server.Close()
+
+	// a client that sends the request and never reads the response
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.(*net.TCPConn).SetReadBuffer(4096)
+	fmt.Fprintf(conn, "GET /metrics HTTP/1.1\r\nHost: %s\r\n\r\n", server.Listener.Addr().String())
+
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("expected writing to a stalled client to be aborted")
+	}
+	if !strings.Contains(logs.String(), "Aborted writing metrics to 127.0.0.1 after it accepted nothing for 50ms") {
+		t.Errorf("expected the aborted write to be logged, got:\n%s", logs.String())
+	}
+}
+
+func TestProtobufHandler(t *testing.T) {
+	server := newFixtureServer("histogram.txt")
+	defer server.Close()
+	config := &Config{Targets: []*Target{{URL: server.URL}}}
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}}
+
+	text := httptest.NewRecorder()
+	metricsHandler(config, aggregator)(text, httptest.NewRequest("GET", "/metrics", nil))
+	expected, err := getMetricFamilies(text.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	formatHandler(config, aggregator, "protobuf")(rec, httptest.NewRequest("GET", "/metrics.pb?format=text", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != string(expfmt.FmtProtoDelim) {
+		t.Errorf("expected protobuf regardless of ?format=, got %s", ct)
+	}
+	decoder := expfmt.NewDecoder(rec.Body, expfmt.FmtProtoDelim)
+	decoded := 0
+	for {
+		mf := &io_prometheus_client.MetricFamily{}
+		if err := decoder.Decode(mf); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(mf, expected[mf.GetName()]) {
+			t.Errorf("expected %s to match the text output, got %v", mf.GetName(), mf)
+		}
+		decoded++
+	}
+	if decoded != len(expected) {
+		t.Errorf("expected %d families, got %d", len(expected), decoded)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that can be written to by the log package
+// from the goroutines of a server while a test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
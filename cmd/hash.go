@@ -0,0 +1,52 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_model/go"
+)
+
+// addOutputHash adds the ae_output_hash gauge for -output.hash. Its value is
+// a hash of the names, types and label sets of families, leaving out the
+// sample values, so it only changes when the shape of the output does e.g.
+// a target starts exposing a new label. A 32 bit hash is used so that it is
+// represented exactly as a sample value.
+func addOutputHash(families map[string]*io_prometheus_client.MetricFamily) {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := fnv.New32a()
+	for _, name := range names {
+		mf := families[name]
+		hash.Write([]byte(name + " " + mf.GetType().String() + "\n"))
+
+		series := make([]string, 0, len(mf.Metric))
+		for _, m := range mf.Metric {
+			labels := make([]string, 0, len(m.Label))
+			for _, l := range m.Label {
+				labels = append(labels, l.GetName()+"="+l.GetValue())
+			}
+			sort.Strings(labels)
+			series = append(series, strings.Join(labels, "\xff"))
+		}
+		sort.Strings(series)
+		for _, s := range series {
+			hash.Write([]byte(s + "\n"))
+		}
+	}
+
+	addFamily(families, &io_prometheus_client.MetricFamily{
+		Name: proto.String("ae_output_hash"),
+		Help: proto.String("Hash of the names and labels of the aggregated series, which changes when their shape does."),
+		Type: io_prometheus_client.MetricType_GAUGE.Enum(),
+		Metric: []*io_prometheus_client.Metric{
+			{Gauge: &io_prometheus_client.Gauge{Value: proto.Float64(float64(hash.Sum32()))}},
+		},
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_model/go"
+)
+
+func hashOf(families ...*io_prometheus_client.MetricFamily) float64 {
+	byName := map[string]*io_prometheus_client.MetricFamily{}
+	for _, mf := range families {
+		byName[mf.GetName()] = mf
+	}
+	addOutputHash(byName)
+	return byName["ae_output_hash"].Metric[0].GetGauge().GetValue()
+}
+
+func TestAddOutputHash(t *testing.T) {
+	first, second := labelledFamily("a", "1", "b", "2"), labelledFamily("b", "2", "a", "1")
+	second.Metric[0].Gauge.Value = proto.Float64(42)
+	if hashOf(first) != hashOf(second) {
+		t.Error("expected the hash to ignore label order and sample values")
+	}
+
+	both := labelledFamily("a", "1")
+	both.Metric = append(both.Metric, labelledFamily("a", "2").Metric...)
+	reversed := labelledFamily("a", "2")
+	reversed.Metric = append(reversed.Metric, labelledFamily("a", "1").Metric...)
+	if hashOf(both) != hashOf(reversed) {
+		t.Error("expected the hash to ignore the order of series")
+	}
+
+	if hashOf(labelledFamily("a", "1")) == hashOf(labelledFamily("a", "1", "c", "3")) {
+		t.Error("expected a new label to change the hash")
+	}
+	renamed := labelledFamily("a", "1")
+	renamed.Name = proto.String("renamed")
+	if hashOf(labelledFamily("a", "1")) == hashOf(renamed) {
+		t.Error("expected a new family name to change the hash")
+	}
+}
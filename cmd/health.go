@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// checkHealth requests the health_url of target and returns an error unless
+// it answers with a 2xx status, so an unhealthy target is not scraped.
+func (f *Aggregator) checkHealth(target *Target) error {
+	res, err := f.clientFor(target).Get(target.HealthURL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	defer func(enabled bool) { *scrapeMetricsEnabled = enabled }(*scrapeMetricsEnabled)
+	*scrapeMetricsEnabled = true
+
+	var healthy, scrapes int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			if atomic.LoadInt32(&healthy) == 0 {
+				http.Error(rw, "down", http.StatusServiceUnavailable)
+			}
+			return
+		}
+		atomic.AddInt32(&scrapes, 1)
+		io.WriteString(rw, "work_total 1\n")
+	}))
+	defer server.Close()
+
+	target := &Target{URL: server.URL + "/metrics", HealthURL: server.URL + "/health"}
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}}
+	output := &bytes.Buffer{}
+	aggregator.Aggregate([]*Target{target}, output, AggregateOptions{})
+	if n := atomic.LoadInt32(&scrapes); n != 0 {
+		t.Errorf("expected an unhealthy target not to be scraped, got %d scrapes", n)
+	}
+	if expected := fmt.Sprintf(`ae_up{ae_source="%s"} 0`, target.URL); !strings.Contains(output.String(), expected) {
+		t.Errorf("expected %s in:\n%s", expected, output.String())
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	output.Reset()
+	aggregator.Aggregate([]*Target{target}, output, AggregateOptions{})
+	if n := atomic.LoadInt32(&scrapes); n != 1 || !strings.Contains(output.String(), "work_total") {
+		t.Errorf("expected a healthy target to be scraped, got %d scrapes and:\n%s", n, output.String())
+	}
+}
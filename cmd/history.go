@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// historyEntry is a past scrape of a target as served by
+// /api/targets/<name>/history.
+type historyEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	refreshStatus
+}
+
+// scrapeHistory keeps the last -targets.history.size scrapes of every target
+// so flapping targets can be looked into without the logs.
+type scrapeHistory struct {
+	mu      sync.Mutex
+	targets map[*Target]*historyRing
+}
+
+// historyRing is a fixed size buffer overwriting its oldest entry when full.
+type historyRing struct {
+	entries []historyEntry
+	next    int
+	full    bool
+}
+
+func (h *scrapeHistory) record(target *Target, result *Result) {
+	if *targetHistorySize <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.targets == nil {
+		h.targets = make(map[*Target]*historyRing)
+	}
+	ring, ok := h.targets[target]
+	if !ok || len(ring.entries) != *targetHistorySize {
+		ring = &historyRing{entries: make([]historyEntry, *targetHistorySize)}
+		h.targets[target] = ring
+	}
+	ring.entries[ring.next] = historyEntry{Timestamp: time.Now(), refreshStatus: newRefreshStatus(result)}
+	ring.next = (ring.next + 1) % len(ring.entries)
+	if ring.next == 0 {
+		ring.full = true
+	}
+}
+
+// retarget moves the history of the targets in moved to those replacing them
+// after a reload and forgets targets that were removed.
+func (h *scrapeHistory) retarget(moved map[*Target]*Target) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	targets := make(map[*Target]*historyRing, len(h.targets))
+	for target, ring := range h.targets {
+		if replacement, ok := moved[target]; ok {
+			targets[replacement] = ring
+		}
+	}
+	h.targets = targets
+}
+
+// entries returns the recorded scrapes of target, oldest first.
+func (h *scrapeHistory) entries(target *Target) []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ring, ok := h.targets[target]
+	if !ok {
+		return []historyEntry{}
+	}
+	if !ring.full {
+		return append([]historyEntry{}, ring.entries[:ring.next]...)
+	}
+	return append(append([]historyEntry{}, ring.entries[ring.next:]...), ring.entries[:ring.next]...)
+}
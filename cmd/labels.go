@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_model/go"
+)
+
+// Strategies for -targets.label.conflict.
+const (
+	// labelConflictReplace overwrites the target's value with the injected one.
+	labelConflictReplace = "replace"
+	// labelConflictKeep leaves the target's value and does not inject the label.
+	labelConflictKeep = "keep"
+	// labelConflictRename injects the label with a numeric suffix e.g. ae_source_2.
+	labelConflictRename = "rename"
+	// labelConflictError drops the metric.
+	labelConflictError = "error"
+)
+
+// Positions for -targets.label.position.
+const (
+	// labelPositionLast appends the source label after the target's own labels.
+	labelPositionLast = "last"
+	// labelPositionFirst puts the source label before the target's own labels.
+	labelPositionFirst = "first"
+)
+
+func validLabelPosition(position string) bool {
+	return position == labelPositionLast || position == labelPositionFirst
+}
+
+func validLabelConflict(strategy string) bool {
+	switch strategy {
+	case labelConflictReplace, labelConflictKeep, labelConflictRename, labelConflictError:
+		return true
+	}
+	return false
+}
+
+// sourceLabels returns the labels that identify the target at url: the
+// -targets.label.name label, or job and instance labels like Prometheus adds
+// when -targets.label.job is set.
+func sourceLabels(url string) []*io_prometheus_client.LabelPair {
+	if *targetLabelJob == "" {
+		return []*io_prometheus_client.LabelPair{{Name: targetLabelName, Value: proto.String(url)}}
+	}
+	return []*io_prometheus_client.LabelPair{
+		{Name: proto.String("job"), Value: targetLabelJob},
+		{Name: proto.String("instance"), Value: proto.String(targetInstance(url))},
+	}
+}
+
+// targetInstance returns the host:port of url, or url itself if it has no host.
+func targetInstance(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return target
+	}
+	return u.Host
+}
+
+// schemeLabels returns the -targets.label.scheme label with the scheme of the
+// target at url, or nothing if the flag is not set.
+func schemeLabels(target string) []*io_prometheus_client.LabelPair {
+	if *targetLabelScheme == "" {
+		return nil
+	}
+	scheme := ""
+	if u, err := url.Parse(target); err == nil {
+		scheme = u.Scheme
+	}
+	return []*io_prometheus_client.LabelPair{{Name: targetLabelScheme, Value: proto.String(scheme)}}
+}
+
+// isSourceLabelName reports whether name is one of the labels added by sourceLabels.
+func isSourceLabelName(name string) bool {
+	if *targetLabelJob == "" {
+		return name == *targetLabelName
+	}
+	return name == "job" || name == "instance"
+}
+
+// injectLabels adds labels to every metric of mf. Metrics that already have
+// one of the labels are handled according to -targets.label.conflict.
+func injectLabels(mf *io_prometheus_client.MetricFamily, labels []*io_prometheus_client.LabelPair, source string) {
+	if len(labels) == 0 {
+		return
+	}
+	kept := mf.Metric[:0]
+	for _, m := range mf.Metric {
+		if err := injectMetricLabels(m, labels); err != nil {
+			log.Printf("Dropped metric %s from %s: %s", mf.GetName(), source, err.Error())
+			continue
+		}
+		kept = append(kept, m)
+	}
+	mf.Metric = kept
+}
+
+func injectMetricLabels(m *io_prometheus_client.Metric, labels []*io_prometheus_client.LabelPair) error {
+	for _, label := range labels {
+		existing := findLabel(m, label.GetName())
+		if existing == nil {
+			m.Label = append(m.Label, &io_prometheus_client.LabelPair{Name: label.Name, Value: label.Value})
+			continue
+		}
+		labelCollisions.WithLabelValues(*targetLabelConflict).Inc()
+		switch *targetLabelConflict {
+		case labelConflictReplace:
+			existing.Value = label.Value
+		case labelConflictKeep:
+		case labelConflictRename:
+			m.Label = append(m.Label, &io_prometheus_client.LabelPair{Name: proto.String(unusedLabelName(m, label.GetName())), Value: label.Value})
+		default:
+			return fmt.Errorf("label %s is already set to %q", label.GetName(), existing.GetValue())
+		}
+	}
+	return nil
+}
+
+func findLabel(m *io_prometheus_client.Metric, name string) *io_prometheus_client.LabelPair {
+	for _, l := range m.Label {
+		if l.GetName() == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// unusedLabelName returns name suffixed with the lowest number from 2 that
+// does not clash with a label of m.
+func unusedLabelName(m *io_prometheus_client.Metric, name string) string {
+	for i := 2; ; i++ {
+		candidate := name + "_" + strconv.Itoa(i)
+		if findLabel(m, candidate) == nil {
+			return candidate
+		}
+	}
+}
+
+// moveSourceLabelsFirst moves the source labels of every metric of mf before
+// the target's own labels for -targets.label.position=first.
+func moveSourceLabelsFirst(mf *io_prometheus_client.MetricFamily) {
+	for _, m := range mf.Metric {
+		sort.SliceStable(m.Label, func(i, j int) bool {
+			return isSourceLabelName(m.Label[i].GetName()) && !isSourceLabelName(m.Label[j].GetName())
+		})
+	}
+}
+
+// sortMetricLabels sorts the labels of every metric by name. OpenMetrics
+// expects a stable label order and the injected labels are otherwise appended
+// after the target's own. With -targets.label.position=first the source labels
+// stay in front of the sorted rest.
+func sortMetricLabels(families map[string]*io_prometheus_client.MetricFamily) {
+	first := *targetLabelPosition == labelPositionFirst
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			sort.Slice(m.Label, func(i, j int) bool {
+				if first {
+					if a, b := isSourceLabelName(m.Label[i].GetName()), isSourceLabelName(m.Label[j].GetName()); a != b {
+						return a
+					}
+				}
+				return m.Label[i].GetName() < m.Label[j].GetName()
+			})
+		}
+	}
+}
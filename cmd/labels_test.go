@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func labelledFamily(labels ...string) *io_prometheus_client.MetricFamily {
+	m := &io_prometheus_client.Metric{Gauge: &io_prometheus_client.Gauge{Value: proto.Float64(1)}}
+	for i := 0; i < len(labels); i += 2 {
+		m.Label = append(m.Label, &io_prometheus_client.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+	}
+	return &io_prometheus_client.MetricFamily{Name: proto.String("test"), Metric: []*io_prometheus_client.Metric{m}}
+}
+
+func labelString(m *io_prometheus_client.Metric) string {
+	s := ""
+	for _, l := range m.Label {
+		s += l.GetName() + "=" + l.GetValue() + ","
+	}
+	return s
+}
+
+func labelCollisionCount(t *testing.T, strategy string) float64 {
+	for _, m := range gatherSelfMetric(t, "ae_label_collisions_total").GetMetric() {
+		if labelString(m) == "strategy="+strategy+"," {
+			return m.Counter.GetValue()
+		}
+	}
+	return 0
+}
+
+func TestInjectLabelsConflict(t *testing.T) {
+	defer func(strategy string) { *targetLabelConflict = strategy }(*targetLabelConflict)
+
+	injected := []*io_prometheus_client.LabelPair{{Name: proto.String("ae_source"), Value: proto.String("outer")}}
+	for strategy, expected := range map[string]string{
+		labelConflictReplace: "ae_source=outer,",
+		labelConflictKeep:    "ae_source=inner,",
+		labelConflictRename:  "ae_source=inner,ae_source_2=outer,",
+		labelConflictError:   "",
+	} {
+		*targetLabelConflict = strategy
+
+		before := labelCollisionCount(t, strategy)
+		mf := labelledFamily("ae_source", "inner")
+		injectLabels(mf, injected, "http://localhost/metrics")
+		if after := labelCollisionCount(t, strategy); after != before+1 {
+			t.Errorf("expected the %s collision to be counted, went from %v to %v", strategy, before, after)
+		}
+
+		if expected == "" {
+			if len(mf.Metric) != 0 {
+				t.Errorf("expected %s to drop the metric, got %s", strategy, labelString(mf.Metric[0]))
+			}
+			continue
+		}
+		if len(mf.Metric) != 1 || labelString(mf.Metric[0]) != expected {
+			t.Errorf("expected %s to give %s, got %v", strategy, expected, mf.Metric)
+		}
+	}
+}
+
+func TestInjectLabelsWithoutConflict(t *testing.T) {
+	mf := labelledFamily("code", "200")
+	injectLabels(mf, []*io_prometheus_client.LabelPair{{Name: proto.String("ae_source"), Value: proto.String("a")}}, "a")
+	if labelString(mf.Metric[0]) != "code=200,ae_source=a," {
+		t.Errorf("expected label to be appended, got %s", labelString(mf.Metric[0]))
+	}
+}
+
+func TestUnusedLabelName(t *testing.T) {
+	mf := labelledFamily("ae_source", "a", "ae_source_2", "b")
+	if name := unusedLabelName(mf.Metric[0], "ae_source"); name != "ae_source_3" {
+		t.Errorf("expected ae_source_3, got %s", name)
+	}
+}
+
+func TestSourceLabels(t *testing.T) {
+	defer func(job string) { *targetLabelJob = job }(*targetLabelJob)
+
+	m := &io_prometheus_client.Metric{Label: sourceLabels("http://localhost:9100/metrics")}
+	if labelString(m) != "ae_source=http://localhost:9100/metrics," {
+		t.Errorf("expected the target label, got %s", labelString(m))
+	}
+
+	*targetLabelJob = "node"
+	m = &io_prometheus_client.Metric{Label: sourceLabels("http://localhost:9100/metrics")}
+	if labelString(m) != "job=node,instance=localhost:9100," {
+		t.Errorf("expected job and instance labels, got %s", labelString(m))
+	}
+	if !isSourceLabelName("instance") || isSourceLabelName("ae_source") {
+		t.Error("expected job and instance to be reserved instead of the target label")
+	}
+}
+
+func TestSchemeLabels(t *testing.T) {
+	defer func(name string) { *targetLabelScheme = name }(*targetLabelScheme)
+
+	if labels := schemeLabels("https://localhost:9100/metrics"); len(labels) != 0 {
+		t.Errorf("expected no scheme label by default, got %v", labels)
+	}
+
+	*targetLabelScheme = "scheme"
+	for target, expected := range map[string]string{
+		"http://localhost:9100/metrics":  "scheme=http,",
+		"https://localhost:9100/metrics": "scheme=https,",
+		"grpc://localhost:9100/a.B/C":    "scheme=grpc,",
+	} {
+		if s := labelString(&io_prometheus_client.Metric{Label: schemeLabels(target)}); s != expected {
+			t.Errorf("expected %s for %s, got %s", expected, target, s)
+		}
+	}
+
+	server := newFixtureServer("histogram.txt")
+	defer server.Close()
+	output := &bytes.Buffer{}
+	(&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate([]*Target{{URL: server.URL}}, output, AggregateOptions{})
+	if n := strings.Count(output.String(), `scheme="http"`); n != 2 {
+		t.Errorf("expected 2 samples with the scheme label, got %d:\n%s", n, output.String())
+	}
+}
+
+func TestLabelPosition(t *testing.T) {
+	defer func(position string) { *targetLabelPosition = position }(*targetLabelPosition)
+
+	server := newFixtureServer("histogram.txt")
+	defer server.Close()
+	aggregate := func(options AggregateOptions) string {
+		output := &bytes.Buffer{}
+		if err := (&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate([]*Target{{URL: server.URL}}, output, options); err != nil {
+			t.Fatal(err)
+		}
+		return output.String()
+	}
+
+	source := `ae_source="` + server.URL + `"`
+	if output := aggregate(AggregateOptions{}); !strings.Contains(output, `{method="post",code="200",`+source+`}`) {
+		t.Errorf("expected the target label last by default, got:\n%s", output)
+	}
+
+	*targetLabelPosition = labelPositionFirst
+	if output := aggregate(AggregateOptions{}); !strings.Contains(output, `{`+source+`,method="post",code="200"}`) {
+		t.Errorf("expected the target label first, got:\n%s", output)
+	}
+	if output := aggregate(AggregateOptions{Format: expfmt.FmtOpenMetrics}); !strings.Contains(output, `{`+source+`,code="200",method="post"}`) {
+		t.Errorf("expected the target label before the sorted labels, got:\n%s", output)
+	}
+}
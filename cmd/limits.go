@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/prometheus/client_model/go"
+)
+
+// applyLabelLimits drops the metrics of mf that exceed the configured label
+// limits, the same way Prometheus would reject them, so one bad series does
+// not get the whole aggregated scrape rejected downstream.
+func applyLabelLimits(mf *io_prometheus_client.MetricFamily, source string) {
+	if *targetLabelLimit <= 0 && *targetLabelNameLengthLimit <= 0 && *targetLabelValueLengthLimit <= 0 {
+		return
+	}
+	kept := mf.Metric[:0]
+	for _, m := range mf.Metric {
+		if err := checkLabelLimits(m); err != nil {
+			log.Printf("Dropped metric %s from %s: %s", mf.GetName(), source, err.Error())
+			continue
+		}
+		kept = append(kept, m)
+	}
+	mf.Metric = kept
+}
+
+func checkLabelLimits(m *io_prometheus_client.Metric) error {
+	if *targetLabelLimit > 0 && len(m.Label) > *targetLabelLimit {
+		return fmt.Errorf("%d labels exceeds the limit of %d", len(m.Label), *targetLabelLimit)
+	}
+	for _, l := range m.Label {
+		if *targetLabelNameLengthLimit > 0 && len(l.GetName()) > *targetLabelNameLengthLimit {
+			return fmt.Errorf("label name %q exceeds the length limit of %d", l.GetName(), *targetLabelNameLengthLimit)
+		}
+		if *targetLabelValueLengthLimit > 0 && len(l.GetValue()) > *targetLabelValueLengthLimit {
+			return fmt.Errorf("value of label %q exceeds the length limit of %d", l.GetName(), *targetLabelValueLengthLimit)
+		}
+	}
+	return nil
+}
+
+// Ways of handling targets with more families than -targets.family.limit.
+const (
+	familyLimitTruncate = "truncate"
+	familyLimitDrop     = "drop"
+)
+
+func validFamilyLimitAction(action string) bool {
+	return action == familyLimitTruncate || action == familyLimitDrop
+}
+
+// applyFamilyLimit enforces -targets.family.limit on a scraped target, which
+// catches exporters whose number of metrics exploded by accident. Either the
+// families after the first ones by name are dropped or, with
+// -targets.family.limit.action=drop, the whole target fails.
+func applyFamilyLimit(result *Result) {
+	if *targetFamilyLimit <= 0 || result.Error != nil || len(result.MetricFamily) <= *targetFamilyLimit {
+		return
+	}
+	if *targetFamilyLimitAction == familyLimitDrop {
+		result.Error = fmt.Errorf("target %s has %d metric families, more than the limit of %d", result.URL, len(result.MetricFamily), *targetFamilyLimit)
+		result.ErrorCategory = errorFamilyLimit
+		result.MetricFamily = nil
+		return
+	}
+	names := make([]string, 0, len(result.MetricFamily))
+	for name := range result.MetricFamily {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names[*targetFamilyLimit:] {
+		delete(result.MetricFamily, name)
+	}
+	log.Printf("Dropped %d metric families from %s, more than the limit of %d", len(names)-*targetFamilyLimit, result.URL, *targetFamilyLimit)
+}
+
+// Ways of handling NaN and infinite sample values for -targets.non-finite.
+const (
+	nonFinitePass = "pass"
+	nonFiniteDrop = "drop"
+)
+
+func validNonFinite(mode string) bool {
+	return mode == nonFinitePass || mode == nonFiniteDrop
+}
+
+// dropNonFinite removes the samples of mf with a NaN or infinite value in
+// -targets.non-finite=drop mode. Summary quantiles are dropped one by one,
+// since a summary without observations reports NaN for all of them, and
+// other metrics as a whole.
+func dropNonFinite(mf *io_prometheus_client.MetricFamily, source string) {
+	if *targetNonFinite != nonFiniteDrop {
+		return
+	}
+	dropped := 0
+	kept := mf.Metric[:0]
+	for _, m := range mf.Metric {
+		if s := m.Summary; s != nil {
+			quantiles := s.Quantile[:0]
+			for _, q := range s.Quantile {
+				if isFinite(q.GetValue()) {
+					quantiles = append(quantiles, q)
+					continue
+				}
+				dropped++
+			}
+			s.Quantile = quantiles
+		}
+		if !isFinite(m.GetCounter().GetValue()) || !isFinite(m.GetGauge().GetValue()) || !isFinite(m.GetUntyped().GetValue()) ||
+			!isFinite(m.GetSummary().GetSampleSum()) || !isFinite(m.GetHistogram().GetSampleSum()) {
+			dropped++
+			continue
+		}
+		kept = append(kept, m)
+	}
+	mf.Metric = kept
+	if dropped > 0 {
+		nonFiniteDropped.Add(float64(dropped))
+		if *verboseFlag {
+			log.Printf("Dropped %d non-finite samples of %s from %s", dropped, mf.GetName(), source)
+		}
+	}
+}
+
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
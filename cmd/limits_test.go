@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_model/go"
+)
+
+func TestApplyLabelLimits(t *testing.T) {
+	defer func(limit, nameLimit, valueLimit int) {
+		*targetLabelLimit, *targetLabelNameLengthLimit, *targetLabelValueLengthLimit = limit, nameLimit, valueLimit
+	}(*targetLabelLimit, *targetLabelNameLengthLimit, *targetLabelValueLengthLimit)
+	*targetLabelLimit, *targetLabelNameLengthLimit, *targetLabelValueLengthLimit = 2, 8, 8
+
+	metric := func(labels ...string) *io_prometheus_client.Metric {
+		m := &io_prometheus_client.Metric{Gauge: &io_prometheus_client.Gauge{Value: proto.Float64(1)}}
+		for i := 0; i < len(labels); i += 2 {
+			m.Label = append(m.Label, &io_prometheus_client.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+		}
+		return m
+	}
+	mf := &io_prometheus_client.MetricFamily{
+		Name: proto.String("test"),
+		Metric: []*io_prometheus_client.Metric{
+			metric("a", "1", "b", "2"),
+			metric("a", "1", "b", "2", "c", "3"),
+			metric("too_long_name", "1"),
+			metric("a", "too long value"),
+		},
+	}
+
+	applyLabelLimits(mf, "http://localhost/metrics")
+
+	if len(mf.Metric) != 1 || len(mf.Metric[0].Label) != 2 {
+		t.Errorf("expected only the metric within limits to be kept, got %v", mf.Metric)
+	}
+}
+
+func TestDropNonFinite(t *testing.T) {
+	defer func(mode string) { *targetNonFinite = mode }(*targetNonFinite)
+
+	families, err := getMetricFamilies(strings.NewReader(`# TYPE temperature gauge
+temperature{sensor="a"} 21.5
+temperature{sensor="b"} NaN
+temperature{sensor="c"} +Inf
+# TYPE latency summary
+latency{quantile="0.5"} NaN
+latency{quantile="0.9"} 0.2
+latency_sum 1
+latency_count 5
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	*targetNonFinite = nonFinitePass
+	dropNonFinite(families["temperature"], "http://a/metrics")
+	if n := len(families["temperature"].Metric); n != 3 {
+		t.Fatalf("expected samples to be passed through by default, got %d", n)
+	}
+
+	*targetNonFinite = nonFiniteDrop
+	before := gatherSelfMetric(t, "ae_non_finite_samples_dropped_total").Metric[0].GetCounter().GetValue()
+	dropNonFinite(families["temperature"], "http://a/metrics")
+	dropNonFinite(families["latency"], "http://a/metrics")
+	if metrics := families["temperature"].Metric; len(metrics) != 1 || labelString(metrics[0]) != "sensor=a," {
+		t.Errorf("expected only the finite temperature to be kept, got %v", metrics)
+	}
+	if quantiles := families["latency"].Metric[0].GetSummary().GetQuantile(); len(quantiles) != 1 || quantiles[0].GetQuantile() != 0.9 {
+		t.Errorf("expected only the NaN quantile to be dropped, got %v", quantiles)
+	}
+	if dropped := gatherSelfMetric(t, "ae_non_finite_samples_dropped_total").Metric[0].GetCounter().GetValue() - before; dropped != 3 {
+		t.Errorf("expected 3 dropped samples to be counted, got %v", dropped)
+	}
+}
+
+func TestApplyFamilyLimit(t *testing.T) {
+	defer func(limit int, action string) {
+		*targetFamilyLimit, *targetFamilyLimitAction = limit, action
+	}(*targetFamilyLimit, *targetFamilyLimitAction)
+	*targetFamilyLimit = 2
+
+	newResult := func() *Result {
+		families, err := getMetricFamilies(strings.NewReader("c 1\na 1\nb 1\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Result{URL: "http://localhost/metrics", MetricFamily: families}
+	}
+
+	*targetFamilyLimitAction = familyLimitTruncate
+	truncated := newResult()
+	applyFamilyLimit(truncated)
+	if _, ok := truncated.MetricFamily["c"]; truncated.Error != nil || len(truncated.MetricFamily) != 2 || ok {
+		t.Errorf("expected the families after the first 2 by name to be dropped, got %v and error %v", truncated.MetricFamily, truncated.Error)
+	}
+
+	*targetFamilyLimitAction = familyLimitDrop
+	dropped := newResult()
+	applyFamilyLimit(dropped)
+	if dropped.Error == nil || dropped.ErrorCategory != errorFamilyLimit || len(dropped.MetricFamily) != 0 {
+		t.Errorf("expected the target to fail, got %v and error %v", dropped.MetricFamily, dropped.Error)
+	}
+
+	*targetFamilyLimit = 3
+	within := newResult()
+	applyFamilyLimit(within)
+	if within.Error != nil || len(within.MetricFamily) != 3 {
+		t.Errorf("expected a target within the limit to be kept, got %v and error %v", within.MetricFamily, within.Error)
+	}
+}
+
+func TestAggregateFamilyLimitAfterMetricNameFilter(t *testing.T) {
+	defer func(path string, limit int, action string) {
+		*configFile, *targetFamilyLimit, *targetFamilyLimitAction = path, limit, action
+	}(*configFile, *targetFamilyLimit, *targetFamilyLimitAction)
+	*targetFamilyLimit = 2
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "a 1\nb 1\nc 1\nd 1\n")
+	}))
+	defer server.Close()
+	*configFile = writeConfigFile(t, fmt.Sprintf(`{"targets": [{"url": %q, "metrics_allow": ["c", "d"]}]}`, server.URL))
+	defer os.Remove(*configFile)
+	config, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, action := range []string{familyLimitTruncate, familyLimitDrop} {
+		*targetFamilyLimitAction = action
+		output := &bytes.Buffer{}
+		if err := (&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate(config.Targets, output, AggregateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		families, err := getMetricFamilies(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(families) != 2 || families["c"] == nil || families["d"] == nil {
+			t.Errorf("%s: expected the allowed families to be within the limit, got %v", action, families)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// utf8BOM is the byte order mark some targets start their response with.
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// lineEndingReader passes on a response with CRLF line endings turned into LF
+// and a leading byte order mark removed, for -web.raw.normalize.
+type lineEndingReader struct {
+	r *bufio.Reader
+}
+
+func newLineEndingReader(r io.Reader) *lineEndingReader {
+	br := bufio.NewReader(r)
+	if b, err := br.Peek(len(utf8BOM)); err == nil && bytes.Equal(b, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+	return &lineEndingReader{r: br}
+}
+
+func (l *lineEndingReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		b, err := l.r.ReadByte()
+		if err != nil {
+			if n > 0 && err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		if b == '\r' {
+			if next, err := l.r.Peek(1); err == nil && next[0] == '\n' {
+				continue
+			}
+		}
+		p[n] = b
+		n++
+		// Return what has been read rather than block for more.
+		if l.r.Buffered() == 0 {
+			break
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestLineEndingReader(t *testing.T) {
+	input := "\xef\xbb\xbf# TYPE up gauge\r\nup 1\r\nlabel{v=\"a\rb\"} 1\r\n"
+	expected := "# TYPE up gauge\nup 1\nlabel{v=\"a\rb\"} 1\n"
+	for name, reader := range map[string]func(string) *lineEndingReader{
+		"whole": func(s string) *lineEndingReader { return newLineEndingReader(strings.NewReader(s)) },
+		"one byte": func(s string) *lineEndingReader {
+			return newLineEndingReader(iotest.OneByteReader(strings.NewReader(s)))
+		},
+	} {
+		b, err := ioutil.ReadAll(reader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, b)
+		}
+	}
+}
+
+func TestTargetHandlerNormalize(t *testing.T) {
+	defer func(normalize bool) { *webRawNormalize = normalize }(*webRawNormalize)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("\xef\xbb\xbfup 1\r\n"))
+	}))
+	defer server.Close()
+	config := &Config{Targets: []*Target{{URL: server.URL}}}
+
+	for normalize, expected := range map[bool]string{false: "\xef\xbb\xbfup 1\r\n", true: "up 1\n"} {
+		*webRawNormalize = normalize
+		rec := httptest.NewRecorder()
+		targetHandler(config, &Aggregator{HTTP: &http.Client{Timeout: time.Second}})(rec, httptest.NewRequest("GET", "/targets/0/metrics", nil))
+		if rec.Body.String() != expected {
+			t.Errorf("expected %q with normalize %v, got %q", expected, normalize, rec.Body.String())
+		}
+	}
+}
@@ -1,20 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"flag"
 	"log"
+	"math"
+	"math/rand"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"syscall"
 
-	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
-	"strconv"
+	"sync"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/semaphore"
 )
 
 //Config is used to store the configuration of this program
@@ -23,7 +37,22 @@ type Config struct {
 		Bind string
 	}
 	Timeout int
-	Targets []string
+	Targets []*Target
+
+	targetsMu sync.RWMutex
+}
+
+// currentTargets returns the targets, which may be replaced by a reload.
+func (c *Config) currentTargets() []*Target {
+	c.targetsMu.RLock()
+	defer c.targetsMu.RUnlock()
+	return c.Targets
+}
+
+func (c *Config) setTargets(targets []*Target) {
+	c.targetsMu.Lock()
+	defer c.targetsMu.Unlock()
+	c.Targets = targets
 }
 
 var (
@@ -34,29 +63,208 @@ var (
 	versionFlag            *bool
 	targetLabelsEnabled    *bool
 	targetLabelName        *string
+	targetLabelJob         *string
+	targetLabelScheme      *string
+	targetLabelPosition    *string
 	serverBind             *string
+	webRequireTarget       *bool
+	webRawNormalize        *bool
+	webSummaryHeaders      *bool
+	webIncludeSelfMetrics  *bool
+	webSampleSeed          *int
+	webMaxConcurrentReqs   *int
+	webProxyHeader         *string
+	webProxyTrusted        *string
+	webReadTimeout         *time.Duration
+	webWriteTimeout        *time.Duration
+	webTLSCertFile         *string
+	webTLSKeyFile          *string
+	webWriteStallTimeout   *time.Duration
+	webWarmup              *time.Duration
+	pushURL                *string
+	pushInterval           *time.Duration
+	pushCollectInterval    *time.Duration
+	tracingEnabled         *bool
 	targetScrapeTimeout    *int
+	targetScrapeTimeoutMax *int
 	targets                *string
 	insecureSkipVerifyFlag *bool
+
+	targetDialTimeout           *int
+	targetBlockPrivate          *bool
+	targetNonFinite             *string
+	targetKeepAlive             *time.Duration
+	targetCacheCompress         *bool
+	targetStaleMax              *time.Duration
+	targetTLSHandshakeTimeout   *int
+	targetResponseHeaderTimeout *int
+	targetResponseHeaderMax     *int
+	targetKeepDuplicates        *bool
+	targetsMax                  *int
+	targetsMaxConcurrency       *int
+	targetsShuffle              *bool
+	targetsMaxTruncate          *bool
+	selfTestFlag                *bool
+	targetScrapeInterval        *time.Duration
+	configFile                  *string
+	targetLabelLimit            *int
+	targetLabelNameLengthLimit  *int
+	targetLabelValueLengthLimit *int
+	targetFamilyLimit           *int
+	targetFamilyLimitAction     *string
+	normalizeMetricNames        *bool
+	targetEmptyAttempts         *int
+	targetEmptyDelay            *time.Duration
+	targetNoContent             *string
+	targetParseTimeout          *int
+	targetPartial               *bool
+	targetParseWorkers          *int
+	scrapeMetricsEnabled        *bool
+	scrapeMetricsCodeLabel      *bool
+	scrapeMetricsLastError      *bool
+	targetReadBufferSize        *int
+	targetParseSanitize         *bool
+	targetZstd                  *bool
+	targetBreakerFailures       *int
+	targetBreakerCooldown       *time.Duration
+	outputEncodeWorkers         *int
+	outputEncodeFallback        *bool
+	outputStats                 *bool
+	outputFile                  *string
+	outputFileInterval          *time.Duration
+	outputEmptyFamilies         *bool
+	outputHash                  *bool
+	outputFormatName            *string
+	outputAggregateMode         *string
+	outputDedupLabels           *string
+	metricsDropLabels           *string
+	outputExemplars             *bool
+	outputTimestamp             *bool
+	targetsStrict               *bool
+	targetsMaxParseFailures     *int
+	targetLabelConflict         *string
+	targetsSequential           *bool
+	targetsCommand              *string
+	targetHistorySize           *int
+	targetsCommandInterval      *time.Duration
+	targetsDefaultScheme        *string
+	targetsURL                  *string
+	targetsURLInterval          *time.Duration
+	targetDownAfter             *int
+	targetTLSMinVersion         *string
+	targetTLSMaxVersion         *string
+	targetTLSCipherSuites       *string
+	targetsConditional          *bool
 )
 
 func init() {
 	verboseFlag = boolFlag(flag.CommandLine, "verbose", false, "Log more information")
 	versionFlag = boolFlag(flag.CommandLine, "version", false, "Show version and exit")
-	serverBind = stringFlag(flag.CommandLine, "server.bind", ":8080", "Bind the HTTP server to this address e.g. 127.0.0.1:8080 or just :8080")
+	selfTestFlag = boolFlag(flag.CommandLine, "self-test", false, "Check that metrics survive being encoded in -output.format and parsed again before starting the server")
+	serverBind = stringFlag(flag.CommandLine, "server.bind", ":8080", "Bind the HTTP server to this address e.g. 127.0.0.1:8080 or just :8080 (empty means no server is started, for use with -output.file or -push.url)")
+	webRequireTarget = boolFlag(flag.CommandLine, "web.require-target", false, "Reject /metrics requests that do not select targets with ?t= or ?select= instead of scraping all targets")
+	webRawNormalize = boolFlag(flag.CommandLine, "web.raw.normalize", false, "Convert CRLF line endings to LF and strip a leading byte order mark from responses proxied by /targets/<name>/metrics")
+	webIncludeSelfMetrics = boolFlag(flag.CommandLine, "web.include-self-metrics", false, "Also serve the metrics of /self-metrics on /metrics, renamed from ae_ to ae_self_ so they do not collide with those of the targets")
+	webSummaryHeaders = boolFlag(flag.CommandLine, "web.summary-headers", false, "Add X-Aggregate-Targets-Total, X-Aggregate-Targets-Failed and X-Aggregate-Duration-Ms headers to /metrics responses")
+	webMaxConcurrentReqs = intFlag(flag.CommandLine, "web.max.concurrent.requests", 0, "Reject requests that scrape targets, to /metrics, /metrics.pb, /targets/ and /api/targets/, with 503 while this many of them are already being handled (0 means no limit)")
+	webSampleSeed = intFlag(flag.CommandLine, "web.sample.seed", 0, "Seed used to pick the targets of /metrics?sample= requests so the same subset is scraped each time (0 means a new random subset per request)")
+	webProxyHeader = stringFlag(flag.CommandLine, "web.proxy-header", "", "Take the client address for logs from this header set by a trusted reverse proxy e.g. X-Forwarded-For, using its right-most address that is not a -web.proxy-trusted proxy (empty means the remote address is used)")
+	webProxyTrusted = stringFlag(flag.CommandLine, "web.proxy-trusted", "", "Comma separated addresses and CIDR ranges of the reverse proxies whose -web.proxy-header is trusted; requests from other addresses are logged with their remote address (empty means only the proxy sending the request is trusted)")
+	webReadTimeout = durationFlag(flag.CommandLine, "web.read-timeout", 0, "Maximum time to read a request from a client (0 means no timeout)")
+	webWriteTimeout = durationFlag(flag.CommandLine, "web.write-timeout", 0, "Maximum time from reading a request to finishing writing the response, which includes scraping the targets (0 means no timeout)")
+	webTLSCertFile = stringFlag(flag.CommandLine, "web.tls.cert-file", "", "Serve HTTPS with this certificate, loaded again when it changes or on SIGHUP (empty means HTTP is served)")
+	webTLSKeyFile = stringFlag(flag.CommandLine, "web.tls.key-file", "", "Private key of -web.tls.cert-file")
+	tracingEnabled = boolFlag(flag.CommandLine, "tracing.enabled", false, "Export OpenTelemetry traces of /metrics requests and target fetches over OTLP/HTTP, configured with the OTEL_EXPORTER_OTLP_* environment variables")
+	pushURL = stringFlag(flag.CommandLine, "push.url", "", "Also push the aggregated metrics to this Pushgateway group URL e.g. http://pushgateway:9091/metrics/job/aggregate (empty means metrics are only served)")
+	pushInterval = durationFlag(flag.CommandLine, "push.interval", time.Minute, "Push the aggregated metrics to -push.url this often")
+	pushCollectInterval = durationFlag(flag.CommandLine, "push.collect.interval", 0, "Aggregate the targets this often between pushes and push the latest sample of every series seen since the last push (0 means the targets are aggregated once per push)")
+	webWarmup = durationFlag(flag.CommandLine, "web.warmup", 0, "Wait up to this long on startup for the first background scrape of every target before serving requests (0 means requests are served right away)")
+	webWriteStallTimeout = durationFlag(flag.CommandLine, "web.write-stall-timeout", 0, "Abort writing the metrics to a client that has not accepted any of them for this long (0 means no timeout)")
+	configFile = stringFlag(flag.CommandLine, "config.file", "", "Path to a JSON file with additional targets and their settings")
 
 	targetScrapeTimeout = intFlag(flag.CommandLine, "targets.scrape.timeout", 1000, "If a target metrics pages does not responde with this many miliseconds then timeout")
-	targets = stringFlag(flag.CommandLine, "targets", "", "comma separated list of targets e.g. http://localhost:8081/metrics,http://localhost:8082/metrics")
+	targetScrapeTimeoutMax = intFlag(flag.CommandLine, "targets.scrape.timeout.max", 0, "Double the timeout of a target after each of its scrapes that timed out, up to this many miliseconds, and halve it again after each success (0 means the timeout is fixed)")
+	targets = stringFlag(flag.CommandLine, "targets", "", "comma separated list of targets e.g. http://localhost:8081/metrics,http://localhost:8082/metrics or - to read newline separated targets from stdin")
 	targetLabelsEnabled = boolFlag(flag.CommandLine, "targets.label", true, "Add a label to metrics to show their origin target")
 	targetLabelName = stringFlag(flag.CommandLine, "targets.label.name", "ae_source", "Label name to use if a target name label is appended to metrics")
+	targetLabelJob = stringFlag(flag.CommandLine, "targets.label.job", "", "Label metrics with job set to this and instance set to the target's host:port instead of the target label")
+	targetLabelScheme = stringFlag(flag.CommandLine, "targets.label.scheme", "", "Label metrics with the scheme of their target's URL, e.g. http or https, using this label name (empty means no label)")
+	targetLabelPosition = stringFlag(flag.CommandLine, "targets.label.position", labelPositionLast, "Where to put the target label among a metric's labels: last or first")
+	targetLabelConflict = stringFlag(flag.CommandLine, "targets.label.conflict", labelConflictRename, "What to do when a metric already has a label that is added by the exporter: replace, keep, rename or error")
+	targetLabelLimit = intFlag(flag.CommandLine, "targets.label.limit", 0, "Drop metrics with more labels than this, including the target label (0 means no limit)")
+	targetLabelNameLengthLimit = intFlag(flag.CommandLine, "targets.label.name.length.limit", 0, "Drop metrics with a label name longer than this (0 means no limit)")
+	targetLabelValueLengthLimit = intFlag(flag.CommandLine, "targets.label.value.length.limit", 0, "Drop metrics with a label value longer than this (0 means no limit)")
+	targetFamilyLimit = intFlag(flag.CommandLine, "targets.family.limit", 0, "Limit the number of metric families a single target contributes after its metrics_allow and metrics_deny patterns are applied, see -targets.family.limit.action (0 means no limit)")
+	targetFamilyLimitAction = stringFlag(flag.CommandLine, "targets.family.limit.action", familyLimitTruncate, "What to do with a target exceeding -targets.family.limit: truncate its families to the first ones by name or drop the target as failed")
+
+	outputEncodeWorkers = intFlag(flag.CommandLine, "output.encode.workers", 1, "Encode the aggregated metric families with this many goroutines, which only helps on machines with several CPUs")
+	outputFile = stringFlag(flag.CommandLine, "output.file", "", "Also write the aggregated metrics in the text format to this file every -output.file.interval, replacing it atomically e.g. for the node_exporter textfile collector (empty means no file is written)")
+	outputFileInterval = durationFlag(flag.CommandLine, "output.file.interval", time.Minute, "Write the aggregated metrics to -output.file this often")
+	outputStats = boolFlag(flag.CommandLine, "output.stats", false, "End text output with comments summarizing the aggregation: the number of targets, how many succeeded and failed, the duration and the number of series")
+	outputEncodeFallback = boolFlag(flag.CommandLine, "output.encode.fallback", false, "Encode the whole response as text instead if encoding it as OpenMetrics fails, which buffers OpenMetrics responses until they are complete")
+	outputEmptyFamilies = boolFlag(flag.CommandLine, "output.empty.families", false, "Keep the HELP and TYPE lines of metric families whose samples were all dropped by limits or post-processing")
+	metricsDropLabels = stringFlag(flag.CommandLine, "metrics.drop-labels", "", "Comma separated labels removed from every aggregated metric, keeping only the series of the target given first when several are left with the same labels (empty means no labels are removed)")
+	outputDedupLabels = stringFlag(flag.CommandLine, "output.dedup.labels", "", "Comma separated labels that identify a series: metrics of a family with the same values for them are duplicates and only the one of the target given first is kept (empty means no deduplication)")
+	outputExemplars = boolFlag(flag.CommandLine, "output.exemplars", false, "Add the target label to the exemplars targets expose on counters and histogram buckets in OpenMetrics output so a sample can be traced to its target, only with -output.aggregate.mode none and without making up exemplars for samples that have none")
+	outputTimestamp = boolFlag(flag.CommandLine, "output.timestamp", false, "Set the timestamp of every sample to the time of the aggregation, replacing any timestamp sent by the targets")
+	outputAggregateMode = stringFlag(flag.CommandLine, "output.aggregate.mode", aggregateModeNone, "How series of different targets are combined: none keeps them apart, sum adds up counters and histograms that only differ by their target, max, min and avg keep the highest, lowest or average value of gauges, counters and untyped series that only differ by their target")
+	outputHash = boolFlag(flag.CommandLine, "output.hash", false, "Add an ae_output_hash gauge with a hash of the names and labels of the aggregated series, which changes when their shape does")
+	outputFormatName = stringFlag(flag.CommandLine, "output.format", "text", "Exposition format of the aggregated metrics (text, openmetrics or protobuf), can be overridden per request with ?format=")
+	normalizeMetricNames = boolFlag(flag.CommandLine, "metrics.normalize.names", false, "Rewrite metric names to snake_case and replace invalid characters with underscores")
+
+	scrapeMetricsEnabled = boolFlag(flag.CommandLine, "targets.scrape.metrics", false, "Add ae_up, ae_scrape_error, ae_last_scrape_timestamp_seconds and ae_scrape_response_bytes metrics for every target to the output")
+	scrapeMetricsCodeLabel = boolFlag(flag.CommandLine, "targets.scrape.metrics.code", false, "Add the HTTP status code of the target response as a code label to ae_up and ae_scrape_error")
+	scrapeMetricsLastError = boolFlag(flag.CommandLine, "targets.scrape.metrics.last-error", false, "Add ae_scrape_last_error with the category of the latest failure as an error label to the -targets.scrape.metrics of every target that failed before")
 
 	insecureSkipVerifyFlag = boolFlag(flag.CommandLine, "insecure-skip-verify", false, "Disable verification of TLS certificates")
 
-	flag.Parse()
+	targetTLSMinVersion = stringFlag(flag.CommandLine, "targets.tls.min-version", "", "Minimum TLS version used to scrape targets: 1.0, 1.1, 1.2 or 1.3")
+	targetTLSMaxVersion = stringFlag(flag.CommandLine, "targets.tls.max-version", "", "Maximum TLS version used to scrape targets: 1.0, 1.1, 1.2 or 1.3")
+	targetTLSCipherSuites = stringFlag(flag.CommandLine, "targets.tls.cipher-suites", "", "comma separated list of cipher suites allowed up to TLS 1.2 e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+
+	targetNonFinite = stringFlag(flag.CommandLine, "targets.non-finite", nonFinitePass, "What to do with samples whose value is NaN or infinite: pass them through or drop them")
+	targetBlockPrivate = boolFlag(flag.CommandLine, "targets.block-private", false, "Refuse to connect to targets at private, loopback or link-local addresses, checked after their names are resolved, also when they are scraped through a proxy; cannot be combined with ssh targets")
+	targetDialTimeout = intFlag(flag.CommandLine, "targets.dial.timeout", 0, "If a connection to a target cannot be established within this many miliseconds then timeout (0 means only targets.scrape.timeout applies)")
+	targetKeepAlive = durationFlag(flag.CommandLine, "targets.keepalive", 30*time.Second, "Interval of TCP keep-alive probes on connections to targets so dead targets are noticed sooner (negative disables them)")
+	targetTLSHandshakeTimeout = intFlag(flag.CommandLine, "targets.tls.handshake.timeout", 0, "If a TLS handshake with a target does not complete within this many miliseconds then timeout (0 means only targets.scrape.timeout applies)")
+	targetResponseHeaderMax = intFlag(flag.CommandLine, "targets.response.header.max-bytes", 0, "Fail scrapes of targets whose response headers are larger than this many bytes (0 means the default of 1MB)")
+	targetResponseHeaderTimeout = intFlag(flag.CommandLine, "targets.response.header.timeout", 0, "If a target does not send response headers within this many miliseconds of the request being written then timeout (0 means only targets.scrape.timeout applies)")
+	targetKeepDuplicates = boolFlag(flag.CommandLine, "targets.keep.duplicates", false, "Scrape a target once for every time it is listed instead of dropping duplicates")
+	targetsDefaultScheme = stringFlag(flag.CommandLine, "targets.default-scheme", "", "Scheme prepended to targets given without one e.g. localhost:9100/metrics, http or https (empty means targets must have a scheme)")
+	targetsMax = intFlag(flag.CommandLine, "targets.max", 0, "Fail to load the targets if there are more than this (0 means no limit)")
+	targetsMaxConcurrency = intFlag(flag.CommandLine, "targets.max.concurrency", 0, "Scrape at most this many targets at once when metrics are requested (0 means no limit)")
+	targetsShuffle = boolFlag(flag.CommandLine, "targets.shuffle", false, "Dispatch the scrapes of every request in a random order so the same targets do not always wait longest for a -targets.max.concurrency slot (ignored with -targets.sequential)")
+	targetsMaxTruncate = boolFlag(flag.CommandLine, "targets.max.truncate", false, "Log a warning and use the first -targets.max targets instead of failing when there are more")
+	targetBreakerFailures = intFlag(flag.CommandLine, "targets.breaker.failures", 0, "Stop scraping a target for targets.breaker.cooldown after it failed this many times in a row (0 means targets are always scraped)")
+	targetBreakerCooldown = durationFlag(flag.CommandLine, "targets.breaker.cooldown", time.Minute, "How long to skip a target once it reached targets.breaker.failures before trying it again")
+	targetsConditional = boolFlag(flag.CommandLine, "targets.conditional", false, "Send If-None-Match and If-Modified-Since to targets and reuse the previous metrics when they answer 304 Not Modified")
+	targetDownAfter = intFlag(flag.CommandLine, "targets.down.after", 1, "In background scraping keep serving the last successful result of a target until it failed this many times in a row")
+	targetNoContent = stringFlag(flag.CommandLine, "targets.no-content", noContentParse, "What to do with targets responding 204 No Content: parse the empty body like any other response, count it as a success without metrics even with -targets.empty.attempts, or as an error")
+	targetEmptyAttempts = intFlag(flag.CommandLine, "targets.empty.attempts", 0, "Scrape a target that responds without any metrics up to this many times before reporting it as failed (0 means empty responses are accepted)")
+	targetEmptyDelay = durationFlag(flag.CommandLine, "targets.empty.delay", 100*time.Millisecond, "Wait this long before scraping a target again after it responded without any metrics, doubling the wait after each attempt up to the scrape timeout of the target (0 means the target is scraped again right away)")
+	targetPartial = boolFlag(flag.CommandLine, "targets.partial", false, "Keep the complete metric families a target sent before its scrape timed out instead of failing the scrape")
+	targetParseTimeout = intFlag(flag.CommandLine, "targets.parse.timeout", 0, "Fail a scrape if parsing the response takes longer than this many miliseconds, not counting the time to download it, which is then read into memory first (0 means no limit)")
+	targetParseWorkers = intFlag(flag.CommandLine, "targets.parse.workers", 0, "Read target responses fully and parse them with this many goroutines shared by all scrapes (0 means each scrape parses its own response as it is read)")
+	targetParseSanitize = boolFlag(flag.CommandLine, "targets.parse.sanitize", false, "Repair label values with new lines, stray quotes, invalid escapes or control characters instead of failing the scrape of the target")
+	targetReadBufferSize = intFlag(flag.CommandLine, "targets.read.buffer.size", 0, "Size in bytes of the buffer used to read target responses (0 means the parser default of 4096)")
+	targetZstd = boolFlag(flag.CommandLine, "targets.zstd", false, "Ask targets for zstd compressed responses and decompress them before parsing")
+	targetHistorySize = intFlag(flag.CommandLine, "targets.history.size", 10, "Number of past scrapes of each target served by /api/targets/<name>/history (0 means no history is kept)")
+	targetsCommand = stringFlag(flag.CommandLine, "targets.command", "", "Shell command printing newline separated targets to scrape in addition to -targets, run again every -targets.command.interval")
+	targetsCommandInterval = durationFlag(flag.CommandLine, "targets.command.interval", time.Minute, "How often to run -targets.command, which is also its timeout")
+	targetsURL = stringFlag(flag.CommandLine, "targets.url", "", "URL returning newline separated targets or a JSON array of them to scrape in addition to -targets, fetched again every -targets.url.interval")
+	targetsURLInterval = durationFlag(flag.CommandLine, "targets.url.interval", time.Minute, "How often to fetch -targets.url, which is also its timeout")
+	targetsSequential = boolFlag(flag.CommandLine, "targets.sequential", false, "Scrape targets one at a time in the order they are listed")
+	targetsMaxParseFailures = intFlag(flag.CommandLine, "targets.max.parse.failures", 0, "Respond with 502 and no metrics at all if more than this many targets send a response that cannot be parsed (0 means no limit)")
+	targetsStrict = boolFlag(flag.CommandLine, "targets.strict", false, "Respond with 503 and no metrics at all if any target fails")
+	targetScrapeInterval = durationFlag(flag.CommandLine, "targets.scrape.interval", 0, "Scrape targets in the background this often and serve the latest results (0 means targets are scraped when metrics are requested)")
+	targetCacheCompress = boolFlag(flag.CommandLine, "targets.cache.compress", false, "Keep the results of background scrapes gzip compressed and decompress them for every request, trading CPU for memory")
+	targetStaleMax = durationFlag(flag.CommandLine, "targets.stale.max", 0, "Serve the last successful scrape of a failing target if it is no older than this, while still reporting the target as down (0 means failed targets are left out)")
 }
 
 func main() {
 
+	flag.Parse()
+
 	if *versionFlag {
 		fmt.Print(Version)
 		os.Exit(0)
@@ -69,135 +277,989 @@ func main() {
 			Bind: *serverBind,
 		},
 		Timeout: *targetScrapeTimeout,
-		Targets: filterEmptyStrings(strings.Split(*targets, ",")),
 	}
 
-	if len(config.Targets) < 1 {
-		log.Fatal("No targets configured")
+	if *targetsDefaultScheme != "" && *targetsDefaultScheme != "http" && *targetsDefaultScheme != "https" {
+		log.Fatalf("Invalid targets.default-scheme %q, must be http or https", *targetsDefaultScheme)
 	}
 
-	// enable InsecureSkipVerify
-	if *insecureSkipVerifyFlag {
-		log.Printf("disabled verification of TLS certificates")
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	targetURLs := strings.Split(*targets, ",")
+	if *targets == "-" {
+		var err error
+		if targetURLs, err = readTargetList(os.Stdin); err != nil {
+			log.Fatalf("Failed to read targets from stdin: %s", err.Error())
+		}
 	}
+	targetURLs = filterEmptyStrings(targetURLs)
 
-	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Duration(config.Timeout) * time.Millisecond}}
+	loadURLs := targetURLs
+	var command *targetCommand
+	if *targetsCommand != "" {
+		if *targetsCommandInterval <= 0 {
+			log.Fatalf("Invalid targets.command.interval %s, must be positive", *targetsCommandInterval)
+		}
+		command = &targetCommand{command: *targetsCommand, timeout: *targetsCommandInterval}
+		if _, err := command.run(); err != nil {
+			log.Fatalf("Failed to run targets.command: %s", err.Error())
+		}
+		loadURLs = append(append([]string{}, loadURLs...), command.current()...)
+	}
+	var endpoint *targetEndpoint
+	if *targetsURL != "" {
+		if *targetsURLInterval <= 0 {
+			log.Fatalf("Invalid targets.url.interval %s, must be positive", *targetsURLInterval)
+		}
+		endpoint = &targetEndpoint{url: *targetsURL, client: &http.Client{Timeout: *targetsURLInterval}}
+		if _, err := endpoint.run(); err != nil {
+			log.Fatalf("Failed to fetch targets.url: %s", err.Error())
+		}
+		loadURLs = append(append([]string{}, loadURLs...), endpoint.current()...)
+	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
-		defer r.Body.Close()
-		err := r.ParseForm()
-		if err != nil {
-			http.Error(rw, "Bad Request", http.StatusBadRequest)
-			return
+	loaded, err := loadConfig(loadURLs)
+	if err != nil {
+		log.Fatalf("Failed to load targets: %s", err.Error())
+	}
+	config.Targets = loaded.Targets
+
+	if !validLabelConflict(*targetLabelConflict) {
+		log.Fatalf("Invalid targets.label.conflict %q, must be one of replace, keep, rename or error", *targetLabelConflict)
+	}
+
+	if *targetResponseHeaderMax < 0 {
+		log.Fatalf("Invalid targets.response.header.max-bytes %d, must not be negative", *targetResponseHeaderMax)
+	}
+
+	if *targetEmptyDelay < 0 {
+		log.Fatalf("Invalid targets.empty.delay %s, must not be negative", *targetEmptyDelay)
+	}
+
+	if *webMaxConcurrentReqs < 0 {
+		log.Fatalf("Invalid web.max.concurrent.requests %d, must not be negative", *webMaxConcurrentReqs)
+	}
+	if !validLabelPosition(*targetLabelPosition) {
+		log.Fatalf("Invalid targets.label.position %q, must be last or first", *targetLabelPosition)
+	}
+	if *targetLabelScheme != "" && !model.LabelName(*targetLabelScheme).IsValid() {
+		log.Fatalf("Invalid targets.label.scheme %q, must be a valid label name", *targetLabelScheme)
+	}
+
+	if !validFamilyLimitAction(*targetFamilyLimitAction) {
+		log.Fatalf("Invalid targets.family.limit.action %q, must be truncate or drop", *targetFamilyLimitAction)
+	}
+	if !validNoContent(*targetNoContent) {
+		log.Fatalf("Invalid targets.no-content %q, must be parse, success or error", *targetNoContent)
+	}
+	if !validNonFinite(*targetNonFinite) {
+		log.Fatalf("Invalid targets.non-finite %q, must be pass or drop", *targetNonFinite)
+	}
+
+	for _, name := range filterEmptyStrings(strings.Split(*outputDedupLabels, ",")) {
+		if !model.LabelName(name).IsValid() {
+			log.Fatalf("Invalid output.dedup.labels %q, %q is not a valid label name", *outputDedupLabels, name)
 		}
-		if t := r.Form.Get("t"); t != "" {
-			targetKey, err := strconv.Atoi(t)
-			if err != nil || len(config.Targets)-1 < targetKey {
-				http.Error(rw, "Bad Request", http.StatusBadRequest)
-				return
-			}
-			aggregator.Aggregate([]string{config.Targets[targetKey]}, rw)
+	}
+	for _, name := range filterEmptyStrings(strings.Split(*metricsDropLabels, ",")) {
+		if !model.LabelName(name).IsValid() {
+			log.Fatalf("Invalid metrics.drop-labels %q, %q is not a valid label name", *metricsDropLabels, name)
+		}
+	}
+
+	if _, err := parseTrustedProxies(*webProxyTrusted); err != nil {
+		log.Fatalf("Invalid web.proxy-trusted: %s", err.Error())
+	}
+
+	if !validAggregateMode(*outputAggregateMode) {
+		log.Fatalf("Invalid output.aggregate.mode %q, must be none, sum, max, min or avg", *outputAggregateMode)
+	}
+
+	format, err := outputFormat(*outputFormatName)
+	if err != nil {
+		log.Fatalf("Invalid output.format: %s", err.Error())
+	}
+
+	if *selfTestFlag {
+		if err := selfTest(format); err != nil {
+			log.Fatalf("Self test failed: %s", err.Error())
+		}
+		log.Printf("Self test passed")
+	}
+
+	transport, err := newTransport()
+	if err != nil {
+		log.Fatalf("Failed to configure scraping: %s", err.Error())
+	}
+
+	if *tracingEnabled {
+		if err := setupTracing(context.Background()); err != nil {
+			log.Fatalf("Failed to set up tracing: %s", err.Error())
+		}
+	}
+
+	aggregator := &Aggregator{
+		HTTP: &http.Client{
+			Timeout:   time.Duration(config.Timeout) * time.Millisecond,
+			Transport: transport,
+		},
+		Sequential: *targetsSequential,
+	}
+	aggregator.setLabelReplaceRules(loaded.LabelReplace)
+	aggregator.Start(config.Targets)
+	if *webWarmup > 0 {
+		warmupStart := time.Now()
+		if aggregator.WaitWarm(*webWarmup) {
+			log.Printf("Warmed up the cache in %.3f seconds", time.Since(warmupStart).Seconds())
 		} else {
-			aggregator.Aggregate(config.Targets, rw)
+			log.Printf("Warm-up did not finish within %s, serving requests before every target has been scraped", *webWarmup)
 		}
-	})
+	}
+
+	if *pushURL != "" {
+		if *pushInterval <= 0 {
+			log.Fatalf("Invalid push.interval %s, must be positive", *pushInterval)
+		}
+		p := &pusher{config: config, aggregator: aggregator, client: &http.Client{Timeout: *pushInterval}, url: *pushURL}
+		go p.run()
+	}
+
+	if *outputFile != "" {
+		if *outputFileInterval <= 0 {
+			log.Fatalf("Invalid output.file.interval %s, must be positive", *outputFileInterval)
+		}
+		w := &fileWriter{config: config, aggregator: aggregator, path: *outputFile}
+		go w.run(*outputFileInterval)
+	}
+	if config.Server.Bind == "" && *outputFile == "" && *pushURL == "" {
+		log.Fatalf("Invalid server.bind, must be set unless metrics are written to -output.file or pushed to -push.url")
+	}
+
+	reloader := &reloader{config: config, aggregator: aggregator, targetURLs: targetURLs}
+	if command != nil {
+		reloader.sources = append(reloader.sources, command)
+		go reloader.runTargetSource(command, "targets.command", *targetsCommandInterval)
+	}
+	if endpoint != nil {
+		reloader.sources = append(reloader.sources, endpoint)
+		go reloader.runTargetSource(endpoint, "targets.url", *targetsURLInterval)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go reloader.reloadOnSignal(hup)
+
+	limit := limitRequests(*webMaxConcurrentReqs)
+	mux := http.NewServeMux()
+	mux.Handle("/-/reload", reloader)
+	mux.HandleFunc("/api/config", configHandler(config, aggregator, flag.CommandLine))
+	mux.HandleFunc("/api/metric-names", metricNamesHandler(aggregator))
+	mux.HandleFunc("/api/targets/", limit(targetAPIHandler(config, aggregator)))
+	mux.Handle("/self-metrics", promhttp.HandlerFor(selfRegistry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/metrics", limit(metricsHandler(config, aggregator)))
+	mux.HandleFunc("/metrics.pb", limit(formatHandler(config, aggregator, "protobuf")))
+	mux.HandleFunc("/targets/", limit(targetHandler(config, aggregator)))
+
+	if config.Server.Bind == "" {
+		log.Printf("Not starting a server, aggregating targets:\n")
+		for _, t := range config.currentTargets() {
+			log.Printf("  - %s\n", t.URL)
+		}
+		select {}
+	}
 
 	log.Printf("Starting server on %s with targets:\n", config.Server.Bind)
-	for _, t := range config.Targets {
-		log.Printf("  - %s\n", t)
+	for _, t := range config.currentTargets() {
+		log.Printf("  - %s\n", t.URL)
+	}
+	server := &http.Server{
+		Addr:         config.Server.Bind,
+		Handler:      logRequests(mux),
+		ReadTimeout:  *webReadTimeout,
+		WriteTimeout: *webWriteTimeout,
 	}
-	log.Fatal(http.ListenAndServe(config.Server.Bind, mux))
+	if *webTLSCertFile != "" || *webTLSKeyFile != "" {
+		if *webTLSCertFile == "" || *webTLSKeyFile == "" {
+			log.Fatalf("Invalid web.tls.cert-file and web.tls.key-file, both must be set to serve HTTPS")
+		}
+		certs, err := newCertReloader(*webTLSCertFile, *webTLSKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %s", err.Error())
+		}
+		certHup := make(chan os.Signal, 1)
+		signal.Notify(certHup, syscall.SIGHUP)
+		go certs.reloadOnSignal(certHup)
+		server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(server.ListenAndServe())
 }
 
 type Result struct {
 	URL          string
+	Target       *Target
 	SecondsTaken float64
+	StatusCode   int
 	MetricFamily map[string]*io_prometheus_client.MetricFamily
 	Error        error
+
+	// ErrorCategory says why the scrape failed e.g. errorTimeout.
+	ErrorCategory string
+
+	// Stale is set on a failed result that carries the families of the last
+	// successful scrape, see -targets.stale.max.
+	Stale bool
+
+	// ResponseBytes is the size of the response body, after decompression
+	// with -targets.zstd.
+	ResponseBytes int64
+
+	// TooSmall is set when the response was smaller than the MinBytes of the
+	// target.
+	TooSmall bool
+
+	// LastSuccess is when the target was last scraped successfully, zero if
+	// it never was.
+	LastSuccess time.Time
+
+	// LastErrorCategory is the ErrorCategory of the latest failed scrape of
+	// the target, empty if it never failed.
+	LastErrorCategory string
+
+	// Partial is set on a successful result of a scrape that timed out while
+	// reading the response, see -targets.partial.
+	Partial bool
+
+	// compressedFamilies holds MetricFamily of a cached result in
+	// -targets.cache.compress mode, see compressResult.
+	compressedFamilies []byte
 }
 
 type Aggregator struct {
 	HTTP *http.Client
-}
 
-func (f *Aggregator) Aggregate(targets []string, output io.Writer) {
+	// Sequential scrapes targets one at a time in the order they are given
+	// so the output is reproducible.
+	Sequential bool
+
+	// PostProcess, if set, is called with the merged metric families of the
+	// targets before they are encoded. Target labels have already been added
+	// and the families may be modified or removed from the map.
+	PostProcess func(families map[string]*io_prometheus_client.MetricFamily)
+
+	cacheMu  sync.RWMutex
+	cache    map[*Target]*Result
+	failures map[*Target]int
+	stop     chan struct{}
+	warm     *sync.WaitGroup
+	started  []*Target
 
-	resultChan := make(chan *Result, 100)
+	breakers circuitBreakers
+	timeouts adaptiveTimeouts
+
+	lastSuccesses lastSuccesses
+	lastErrors    lastErrors
+	history       scrapeHistory
+
+	labelReplaceMu sync.RWMutex
+	labelReplace   []*labelReplaceRule
+
+	metricNamesMu sync.RWMutex
+	metricNames   map[string][]string
+
+	h2cOnce sync.Once
+	h2c     *http.Client
+
+	noKeepAliveOnce sync.Once
+	noKeepAlive     *http.Client
+
+	ssh sshClients
+
+	conditional conditionalCache
+
+	parsers parsePool
+
+	slotsOnce sync.Once
+	slots     *semaphore.Weighted
+
+	lastGood lastGoodResults
+}
+
+// Start scrapes every target that has an interval in the background. Results
+// are cached and used by Aggregate instead of scraping the target on demand.
+// Calling Start again stops the background scrapes of the previous targets
+// and carries their state over to the targets replacing them, see
+// movedTargets.
+func (f *Aggregator) Start(targets []*Target) {
+	f.cacheMu.Lock()
+	if f.stop != nil {
+		close(f.stop)
+	}
+	f.stop = make(chan struct{})
+	moved := movedTargets(f.started, targets)
+	f.retargetCache(moved)
+	f.started = targets
+	f.warm = &sync.WaitGroup{}
+	stop, warm := f.stop, f.warm
+	f.cacheMu.Unlock()
+	f.retarget(moved)
 
 	for _, target := range targets {
-		go f.fetch(target, resultChan)
+		if target.Interval > 0 {
+			warm.Add(1)
+			go f.scrapeInBackground(target, stop, warm)
+		}
+	}
+}
+
+// Refresh scrapes target now, bypassing its cached result, and caches the
+// new result if the target is scraped in the background.
+func (f *Aggregator) Refresh(ctx context.Context, target *Target) *Result {
+	resultChan := make(chan *Result, 1)
+	f.fetch(ctx, target, resultChan)
+	result := <-resultChan
+	if target.Interval > 0 {
+		f.storeResult(target, result)
+	}
+	return result
+}
+
+// WaitWarm waits up to timeout for the first background scrape of every
+// target given to Start to be cached. It reports whether they all were.
+func (f *Aggregator) WaitWarm(timeout time.Duration) bool {
+	f.cacheMu.RLock()
+	warm := f.warm
+	f.cacheMu.RUnlock()
+	if warm == nil {
+		return true
+	}
+
+	done := make(chan struct{})
+	go func() {
+		warm.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (f *Aggregator) scrapeInBackground(target *Target, stop chan struct{}, warm *sync.WaitGroup) {
+	warmed := false
+	markWarm := func() {
+		if !warmed {
+			warmed = true
+			warm.Done()
+		}
+	}
+	defer markWarm()
+
+	resultChan := make(chan *Result, 1)
+	ticker := time.NewTicker(time.Duration(target.Interval))
+	defer ticker.Stop()
+	for {
+		f.fetch(context.Background(), target, resultChan)
+		result := <-resultChan
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		f.storeResult(target, result)
+		markWarm()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// storeResult caches the latest background scrape of target. A failure only
+// replaces a successful result once the target failed -targets.down.after
+// times in a row, so a single failed scrape does not report it as down.
+func (f *Aggregator) storeResult(target *Target, result *Result) {
+	if *targetCacheCompress && result.Error == nil {
+		result = compressResult(result)
+	}
+
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+	if f.cache == nil {
+		f.cache = make(map[*Target]*Result)
+		f.failures = make(map[*Target]int)
+	}
+
+	if result.Error == nil {
+		delete(f.failures, target)
+		f.cache[target] = result
+		return
+	}
+
+	f.failures[target]++
+	if previous, ok := f.cache[target]; ok && previous.Error == nil && f.failures[target] < *targetDownAfter {
+		log.Printf("Scrape of %s failed %d time(s) in a row, serving the previous result: %s", target.URL, f.failures[target], result.Error.Error())
+		return
+	}
+	f.cache[target] = result
+}
+
+// cachedResult returns a copy of the latest background scrape of target. The
+// families are copied since Aggregate modifies them while merging.
+func (f *Aggregator) cachedResult(target *Target) (*Result, bool) {
+	if target.Interval <= 0 {
+		return nil, false
+	}
+	f.cacheMu.RLock()
+	result, ok := f.cache[target]
+	f.cacheMu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	copied := *result
+	if result.compressedFamilies != nil {
+		families, err := decompressFamilies(result.compressedFamilies)
+		if err != nil {
+			log.Printf("Failed to decompress cached result of %s: %s", target.URL, err.Error())
+			return nil, false
+		}
+		copied.MetricFamily, copied.compressedFamilies = families, nil
+		return &copied, true
+	}
+	copied.MetricFamily = cloneMetricFamilies(result.MetricFamily)
+	return &copied, true
+}
+
+func cloneMetricFamilies(families map[string]*io_prometheus_client.MetricFamily) map[string]*io_prometheus_client.MetricFamily {
+	cloned := make(map[string]*io_prometheus_client.MetricFamily, len(families))
+	for name, mf := range families {
+		cloned[name] = proto.Clone(mf).(*io_prometheus_client.MetricFamily)
+	}
+	return cloned
+}
+
+// AggregateOptions change how Aggregate writes its output.
+type AggregateOptions struct {
+	// Format is the exposition format, expfmt.FmtText if empty.
+	Format expfmt.Format
+
+	// GroupBySource writes the families of each target in a separate block
+	// headed by a "# source:" comment instead of merging them. It is meant for
+	// debugging and only supported by the text format.
+	GroupBySource bool
+
+	// Sample, if between 0 and 1, scrapes only that fraction of the targets
+	// chosen at random with SampleSeed, or a new seed each time if it is 0.
+	Sample     float64
+	SampleSeed int64
+
+	// Scraped, if set, is called with the results of all targets once they
+	// have been scraped and before anything is written to the output.
+	Scraped func(results []*Result)
+
+	// FellBackToText, if set, is called when the output is encoded as text
+	// because encoding it as OpenMetrics failed, see -output.encode.fallback.
+	// It is called before anything is written to the output.
+	FellBackToText func()
+
+	// SelfMetrics adds the metrics of the exporter itself, see
+	// -web.include-self-metrics. It is ignored with GroupBySource.
+	SelfMetrics bool
+
+	// Context carries the span that the fetches are traced under. Fetches
+	// still waiting for a -targets.max.concurrency slot when it is done fail.
+	Context context.Context
+}
+
+// outputGroup is a set of families that are encoded together and the results
+// they came from.
+type outputGroup struct {
+	results  []*Result
+	families map[string]*io_prometheus_client.MetricFamily
+}
+
+// Aggregate scrapes targets and writes their merged metrics to output. In
+// -targets.strict mode nothing is written and an error is returned if any
+// target failed, as it is when more targets than -targets.max.parse.failures
+// failed to parse.
+func (f *Aggregator) Aggregate(targets []*Target, output io.Writer, options AggregateOptions) error {
+
+	startTime := time.Now()
+	defer func() { aggregationDuration.Observe(time.Since(startTime).Seconds()) }()
+
+	format := options.Format
+	if format == "" {
+		format = expfmt.FmtText
 	}
 
-	func(numTargets int, resultChan chan *Result) {
+	if options.Sample > 0 && options.Sample < 1 {
+		targets = sampleTargets(targets, options.Sample, options.SampleSeed)
+	}
 
-		numResuts := 0
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
 
+	resultChan := make(chan *Result, len(targets))
+
+	dispatchOrder := targets
+	if *targetsShuffle && !f.Sequential {
+		dispatchOrder = shuffleTargets(targets)
+	}
+	for _, target := range dispatchOrder {
+		if result, ok := f.cachedResult(target); ok {
+			resultChan <- result
+			continue
+		}
+		if f.Sequential {
+			f.fetch(ctx, target, resultChan)
+			continue
+		}
+		if len(targets) == 1 {
+			// There is nothing to wait for at the same time.
+			f.dispatch(ctx, target, resultChan)
+			continue
+		}
+		go f.dispatch(ctx, target, resultChan)
+	}
+
+	return func(numTargets int, resultChan chan *Result) error {
+
+		results := make([]*Result, 0, numTargets)
 		allFamilies := make(map[string]*io_prometheus_client.MetricFamily)
+		familySources := make(map[string][]string)
+		groups := []*outputGroup{}
+
+		// A single target, e.g. selected with ?t=, has nothing to be merged
+		// with so its families are labelled in place and output as they are.
+		single := numTargets == 1 && !options.GroupBySource && !*normalizeMetricNames
+
+		for len(results) < numTargets {
+			results = append(results, <-resultChan)
+		}
+		// Results are merged in the order their targets were given rather than
+		// the order the scrapes finished, so the series kept by
+		// -output.dedup.labels and -metrics.drop-labels, and the reference
+		// buckets of -output.aggregate=sum, are the same on every scrape.
+		sortResultsByTarget(results, targets)
 
-		for {
-			if numTargets == numResuts {
-				break
+		for _, result := range results {
+			applyMetricNameFilter(result)
+			applyFamilyLimit(result)
+
+			families := allFamilies
+			if options.GroupBySource {
+				families = make(map[string]*io_prometheus_client.MetricFamily)
+				groups = append(groups, &outputGroup{results: []*Result{result}, families: families})
 			}
-			select {
-			case result := <-resultChan:
-				numResuts++
 
-				if result.Error != nil {
-					log.Printf("Fetch error: %s", result.Error.Error())
+			if result.Error != nil {
+				log.Printf("Fetch error (%s): %s", result.ErrorCategory, result.Error.Error())
+				if !result.Stale {
 					continue
 				}
+			}
 
-				for mfName, mf := range result.MetricFamily {
-					if *targetLabelsEnabled {
-						for _, m := range mf.Metric {
-							m.Label = append(m.Label, &io_prometheus_client.LabelPair{Name: targetLabelName, Value: &result.URL})
+			injectedLabels := result.Target.labelPairs()
+			if *targetLabelsEnabled {
+				injectedLabels = append(sourceLabels(result.URL), injectedLabels...)
+			}
+			injectedLabels = append(injectedLabels, schemeLabels(result.URL)...)
+			if single {
+				allFamilies = result.MetricFamily
+				familySources = make(map[string][]string, len(allFamilies))
+			}
+			for mfName, mf := range result.MetricFamily {
+				if *normalizeMetricNames {
+					mfName = normalizeMetricName(mfName)
+					mf.Name = proto.String(mfName)
+				}
+				injectLabels(mf, injectedLabels, result.URL)
+				if *targetLabelsEnabled && *targetLabelPosition == labelPositionFirst {
+					moveSourceLabelsFirst(mf)
+				}
+				if *outputExemplars && format == expfmt.FmtOpenMetrics && *outputAggregateMode == aggregateModeNone {
+					addSourceExemplars(mf, result.URL)
+				}
+				applyLabelLimits(mf, result.URL)
+				dropNonFinite(mf, result.URL)
+				if single {
+					if len(mf.Metric) == 0 {
+						if !*outputEmptyFamilies {
+							delete(allFamilies, mfName)
 						}
+						continue
 					}
-					if existingMf, ok := allFamilies[mfName]; ok {
-						for _, m := range mf.Metric {
-							existingMf.Metric = append(existingMf.Metric, m)
-						}
-					} else {
-						allFamilies[*mf.Name] = mf
+					familySources[mfName] = []string{result.URL}
+					continue
+				}
+				if len(mf.Metric) == 0 {
+					if _, ok := families[mfName]; !ok && *outputEmptyFamilies {
+						families[mfName] = mf
 					}
+					continue
 				}
-				if *verboseFlag {
-					log.Printf("OK: %s was refreshed in %.3f seconds", result.URL, result.SecondsTaken)
+				if existingMf, ok := families[mfName]; ok {
+					for _, m := range mf.Metric {
+						existingMf.Metric = append(existingMf.Metric, m)
+					}
+				} else {
+					families[*mf.Name] = mf
 				}
+				familySources[mfName] = append(familySources[mfName], result.URL)
+			}
+			if *verboseFlag {
+				log.Printf("OK: %s was refreshed in %.3f seconds", result.URL, result.SecondsTaken)
 			}
 		}
 
-		encoder := expfmt.NewEncoder(output, expfmt.FmtText)
-		for _, f := range allFamilies {
-			encoder.Encode(f)
+		f.recordMetricNames(familySources)
+
+		if options.Scraped != nil {
+			options.Scraped(results)
+		}
+
+		if *targetsStrict {
+			for _, result := range results {
+				if result.Error != nil {
+					return fmt.Errorf("strict mode and target %s failed: %s", result.URL, result.Error.Error())
+				}
+			}
+		}
+
+		if *targetsMaxParseFailures > 0 {
+			failed := 0
+			for _, result := range results {
+				if result.Error != nil && result.ErrorCategory == errorParse {
+					failed++
+				}
+			}
+			if failed > *targetsMaxParseFailures {
+				return fmt.Errorf("%w: %d of %d targets, more than the limit of %d", errTooManyParseFailures, failed, len(results), *targetsMaxParseFailures)
+			}
+		}
+
+		if !options.GroupBySource {
+			groups = []*outputGroup{{results: results, families: allFamilies}}
+		}
+
+		for _, group := range groups {
+			applyLabelReplace(group.families, f.labelReplaceRules())
+
+			if drop := filterEmptyStrings(strings.Split(*metricsDropLabels, ",")); len(drop) > 0 {
+				dropLabels(group.families, drop)
+			}
+
+			if dedupLabels := filterEmptyStrings(strings.Split(*outputDedupLabels, ",")); len(dedupLabels) > 0 {
+				dedupFamilies(group.families, dedupLabels)
+			}
+
+			switch *outputAggregateMode {
+			case aggregateModeSum:
+				sumFamilies(group.families)
+			case aggregateModeMax, aggregateModeMin, aggregateModeAvg:
+				combineFamilies(group.families, *outputAggregateMode)
+			}
+
+			if f.PostProcess != nil {
+				f.PostProcess(group.families)
+			}
+
+			if *scrapeMetricsEnabled {
+				addScrapeMetrics(group.families, group.results)
+			}
+
+			addResponseSizeMetrics(group.families, group.results)
+
+			if options.SelfMetrics && !options.GroupBySource {
+				addSelfMetrics(group.families)
+			}
+
+			if *outputHash {
+				addOutputHash(group.families)
+			}
+
+			if *outputTimestamp {
+				setTimestamps(group.families, startTime)
+			}
+
+			if format == expfmt.FmtOpenMetrics {
+				sortMetricLabels(group.families)
+			}
+
+			if options.GroupBySource {
+				writeSourceComment(output, group.results[0])
+			}
+			if err := encodeWithFallback(output, group.families, format, options.FellBackToText); err != nil {
+				log.Printf("Encode error: %s", err.Error())
+			}
+		}
+		if *outputStats && format == expfmt.FmtText {
+			if err := writeStatsComments(output, results, groups, startTime); err != nil {
+				log.Printf("Encode error: %s", err.Error())
+			}
 		}
+		return nil
 
 	}(len(targets), resultChan)
 }
 
-func (f *Aggregator) fetch(target string, resultChan chan *Result) {
+// sampleTargets returns a random fraction of targets, at least one, in their
+// original order.
+func sampleTargets(targets []*Target, fraction float64, seed int64) []*Target {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	n := int(math.Ceil(float64(len(targets)) * fraction))
+	picked := rand.New(rand.NewSource(seed)).Perm(len(targets))[:n]
+	sort.Ints(picked)
+
+	sampled := make([]*Target, 0, n)
+	for _, i := range picked {
+		sampled = append(sampled, targets[i])
+	}
+	return sampled
+}
+
+// shuffleTargets returns targets in a random order for -targets.shuffle, so
+// the targets given last are not always the ones waiting longest for a
+// -targets.max.concurrency slot, and missing -web.write-timeout as a result.
+func shuffleTargets(targets []*Target) []*Target {
+	shuffled := append([]*Target{}, targets...)
+	rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	return shuffled
+}
+
+// sortResultsByTarget puts results in the order their targets were given
+// rather than the order the scrapes finished.
+func sortResultsByTarget(results []*Result, targets []*Target) {
+	position := make(map[*Target]int, len(targets))
+	for i, target := range targets {
+		position[target] = i
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return position[results[i].Target] < position[results[j].Target]
+	})
+}
+
+func writeSourceComment(output io.Writer, result *Result) {
+	if result.Error != nil {
+		fmt.Fprintf(output, "# source: %s failed: %s\n", result.URL, result.Error.Error())
+		return
+	}
+	fmt.Fprintf(output, "# source: %s\n", result.URL)
+}
+
+// fetch scrapes target and sends the result to resultChan. The fetch is traced
+// as a child of the span in ctx.
+func (f *Aggregator) fetch(ctx context.Context, target *Target, resultChan chan *Result) {
+	defer trackFetch()()
+
+	_, span := tracer.Start(ctx, "fetch", trace.WithAttributes(attribute.String("url.full", target.URL)))
+	result := f.fetchResult(target)
+	f.lastSuccesses.record(target, result)
+	f.lastErrors.record(target, result)
+	f.history.record(target, result)
+	endFetchSpan(span, result)
+	resultChan <- result
+}
+
+func (f *Aggregator) fetchResult(target *Target) *Result {
+	if !f.breakers.allow(target) {
+		result := &Result{
+			URL:           target.URL,
+			Target:        target,
+			Error:         fmt.Errorf("skipped scrape of %s after %d or more consecutive failures", target.URL, *targetBreakerFailures),
+			ErrorCategory: errorCircuitOpen,
+		}
+		if *targetStaleMax > 0 {
+			f.lastGood.fill(target, result)
+		}
+		return result
+	}
+
+	var result *Result
+	if target.HealthURL != "" {
+		if err := f.checkHealth(target); err != nil {
+			// A failed health check counts as a failed scrape, so a half-open
+			// breaker is closed again rather than left probing for good.
+			result = &Result{
+				URL:           target.URL,
+				Target:        target,
+				Error:         fmt.Errorf("skipped scrape of %s after its health check %s failed: %s", target.URL, target.HealthURL, err.Error()),
+				ErrorCategory: errorUnhealthy,
+			}
+		}
+	}
+
+	if result == nil {
+		result = f.scrapeUntilNotEmpty(target, target.URL)
+		if result.Error != nil && target.Fallback != "" {
+			log.Printf("Scrape of %s failed, trying fallback %s: %s", target.URL, target.Fallback, result.Error.Error())
+			if fallback := f.scrapeUntilNotEmpty(target, target.Fallback); fallback.Error == nil {
+				result = fallback
+			}
+		}
+	}
+	f.breakers.record(target, result.Error == nil)
+	f.timeouts.record(target, f.HTTP.Timeout, result)
+	if *targetStaleMax > 0 {
+		if result.Error == nil {
+			f.lastGood.store(target, result)
+		} else {
+			f.lastGood.fill(target, result)
+		}
+	}
+	return result
+}
+
+func (f *Aggregator) scrapeUntilNotEmpty(target *Target, url string) *Result {
+	delay := *targetEmptyDelay
+	for attempt := 1; ; attempt++ {
+		result := f.scrape(target, url)
+		if result.Error != nil || len(result.MetricFamily) > 0 || *targetEmptyAttempts <= 0 || isAcceptedNoContent(result) {
+			return result
+		}
+		if attempt >= *targetEmptyAttempts {
+			result.Error = fmt.Errorf("target %s returned no metrics after %d attempts", url, attempt)
+			result.ErrorCategory = errorEmpty
+			return result
+		}
+		// A target that has not collected its metrics yet, e.g. right after
+		// starting, is unlikely to have done so a moment later.
+		if timeout := f.clientFor(target).Timeout; timeout > 0 && delay > timeout {
+			delay = timeout
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// scrape fetches the metrics of target from url, which is either its URL or
+// its fallback. The result is always reported under the target's URL.
+func (f *Aggregator) scrape(target *Target, url string) *Result {
 
 	startTime := time.Now()
-	res, err := f.HTTP.Get(target)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return &Result{URL: target.URL, Target: target, Error: fmt.Errorf("invalid URL %s: %s", url, err.Error()), ErrorCategory: errorOther}
+	}
+	// Validators are only valid for the server that issued them.
+	conditional := *targetsConditional && url == target.URL
+	if conditional {
+		f.conditional.addValidators(target, req)
+	}
+	if *targetZstd {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	client := f.clientFor(target)
+	if timeout := f.timeouts.timeout(target, client.Timeout); timeout != client.Timeout {
+		raised := *client
+		raised.Timeout = timeout
+		client = &raised
+	}
+	res, err := client.Do(req)
 
-	result := &Result{URL: target, SecondsTaken: time.Since(startTime).Seconds(), Error: nil}
+	result := &Result{URL: target.URL, Target: target, SecondsTaken: time.Since(startTime).Seconds(), Error: nil}
 	if res != nil {
-		result.MetricFamily, err = getMetricFamilies(res.Body)
+		defer res.Body.Close()
+		result.StatusCode = res.StatusCode
+		if res.StatusCode == http.StatusNoContent && *targetNoContent != noContentParse {
+			return handleNoContent(result, url)
+		}
+		if res.StatusCode == http.StatusNotModified {
+			// Without earlier metrics to reuse the empty body would pass as a
+			// target without any series.
+			families, ok := f.conditional.families(target)
+			if !conditional || !ok {
+				result.Error = fmt.Errorf("target %s answered 304 Not Modified but there are no earlier metrics of it to reuse", url)
+				result.ErrorCategory = errorOther
+				return result
+			}
+			result.MetricFamily = families
+			return result
+		}
+		var body io.Reader = res.Body
+		if *targetZstd {
+			decoded, done, decodeErr := decodeBody(res)
+			if decodeErr != nil {
+				result.Error = fmt.Errorf("failed to decode target %s response: %s", url, decodeErr.Error())
+				result.ErrorCategory = errorParse
+				return result
+			}
+			defer done()
+			body = decoded
+		}
+		counted := &countingReader{r: body}
+		body = counted
+		var partial bool
+		if *targetPartial {
+			data, truncated, readErr := readPartialBody(body)
+			if readErr != nil {
+				result.Error = fmt.Errorf("failed to read target %s response: %s", url, readErr.Error())
+				result.ErrorCategory = classifyError(readErr, errorOther)
+				return result
+			}
+			body, partial = bytes.NewReader(data), truncated
+		}
+		var exceeded bool
+		if *targetParseWorkers > 0 {
+			result.MetricFamily, exceeded, err = f.parsers.parse(body)
+		} else {
+			result.MetricFamily, exceeded, err = parseResponse(body)
+		}
+		result.ResponseBytes = counted.n
+		if exceeded {
+			result.Error = fmt.Errorf("parsing target %s metrics took longer than %dms", url, *targetParseTimeout)
+			result.ErrorCategory = errorTimeout
+			return result
+		}
+		contentType, notMetrics := unexpectedContentType(res.Header)
+		if err != nil && notMetrics {
+			result.Error = fmt.Errorf("target %s returned %s, not metrics: %s", url, contentType, err.Error())
+			result.ErrorCategory = errorParse
+			return result
+		}
 		if err != nil {
-			result.Error = fmt.Errorf("failed to add labels to target %s metrics: %s", target, err.Error())
-			resultChan <- result
-			return
+			result.Error = fmt.Errorf("failed to add labels to target %s metrics: %s", url, err.Error())
+			result.ErrorCategory = classifyError(err, errorParse)
+			return result
+		}
+		if notMetrics {
+			log.Printf("WARNING: target %s returned %s but its response was parsed as metrics", url, contentType)
+		}
+		if target.MinBytes > 0 && counted.n < target.MinBytes {
+			log.Printf("WARNING: target %s returned %d bytes, less than its min_bytes of %d", url, counted.n, target.MinBytes)
+			result.TooSmall = true
+		}
+		if partial {
+			dropEmptyFamilies(result.MetricFamily)
+			if len(result.MetricFamily) == 0 {
+				result.Error = fmt.Errorf("target %s timed out before sending a complete metric family", url)
+				result.ErrorCategory = errorTimeout
+				return result
+			}
+			log.Printf("WARNING: scrape of %s timed out, keeping the %d complete families received", url, len(result.MetricFamily))
+			result.Partial = true
+			return result
+		}
+		if conditional {
+			f.conditional.store(target, res.Header, result.MetricFamily)
 		}
 	}
 	if err != nil {
-		result.Error = fmt.Errorf("failed to fetch URL %s due to error: %s", target, err.Error())
+		result.Error = fmt.Errorf("failed to fetch URL %s due to error: %s", url, err.Error())
+		result.ErrorCategory = classifyError(err, errorOther)
 	}
-	resultChan <- result
+	return result
 }
 
 func getMetricFamilies(sourceData io.Reader) (map[string]*io_prometheus_client.MetricFamily, error) {
+	if *targetParseSanitize {
+		sourceData = newLabelValueSanitizer(sourceData)
+	}
 	parser := expfmt.TextParser{}
 	metricFamiles, err := parser.TextToMetricFamilies(sourceData)
 	if err != nil {
@@ -206,6 +1268,19 @@ func getMetricFamilies(sourceData io.Reader) (map[string]*io_prometheus_client.M
 	return metricFamiles, nil
 }
 
+// readTargetList reads one target per line from r.
+func readTargetList(r io.Reader) ([]string, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(b), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	return lines, nil
+}
+
 func filterEmptyStrings(ss []string) []string {
 	filtered := []string{}
 	for _, s := range ss {
@@ -215,3 +1290,17 @@ func filterEmptyStrings(ss []string) []string {
 	}
 	return filtered
 }
+
+func filterDuplicateTargets(targets []*Target) []*Target {
+	seen := make(map[string]bool, len(targets))
+	filtered := []*Target{}
+	for _, t := range targets {
+		if seen[t.URL] {
+			log.Printf("WARNING: dropped duplicate target %s", t.URL)
+			continue
+		}
+		seen[t.URL] = true
+		filtered = append(filtered, t)
+	}
+	return filtered
+}
@@ -1,12 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_model/go"
 )
 
 var updateGoldenFile = flag.Bool("update.golden", false, "update golden files")
@@ -18,13 +29,21 @@ func TestMain(m *testing.M) {
 }
 
 func mustOpenFile(name string, flag int) *os.File {
-	file, err := os.OpenFile(fmt.Sprintf("fixture/%s", name), flag, 0666)
+	file, err := os.OpenFile(fmt.Sprintf("../fixture/%s", name), flag, 0666)
 	if err != nil {
 		panic(err)
 	}
 	return file
 }
 
+func mustNewTransport() *http.Transport {
+	transport, err := newTransport()
+	if err != nil {
+		panic(err)
+	}
+	return transport
+}
+
 func mustReadAll(r io.Reader) string {
 	b, err := ioutil.ReadAll(r)
 	if err != nil {
@@ -33,4 +52,431 @@ func mustReadAll(r io.Reader) string {
 	return string(b[:])
 }
 
-//todo: re-implement tests
\ No newline at end of file
+//todo: re-implement tests
+
+func TestFilterDuplicateTargets(t *testing.T) {
+	filtered := filterDuplicateTargets([]*Target{{URL: "http://a/metrics"}, {URL: "http://b/metrics"}, {URL: "http://a/metrics"}})
+	if len(filtered) != 2 || filtered[0].URL != "http://a/metrics" || filtered[1].URL != "http://b/metrics" {
+		t.Errorf("unexpected targets after filtering duplicates: %v", filtered)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	for _, name := range []string{"text", "openmetrics", "protobuf"} {
+		format, err := outputFormat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := selfTest(format); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
+
+func TestAggregateBackgroundScrape(t *testing.T) {
+	var scrapes int32
+	fixture := mustReadAll(mustOpenFile("histogram.txt", os.O_RDONLY))
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&scrapes, 1)
+		io.WriteString(rw, fixture)
+	}))
+	defer server.Close()
+
+	target := &Target{URL: server.URL, Interval: duration(time.Hour)}
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}}
+	aggregator.Start([]*Target{target})
+
+	for i := 0; ; i++ {
+		if _, ok := aggregator.cachedResult(target); ok {
+			break
+		}
+		if i > 100 {
+			t.Fatal("background scrape did not complete")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 2; i++ {
+		output := &bytes.Buffer{}
+		aggregator.Aggregate([]*Target{target}, output, AggregateOptions{})
+		if n := strings.Count(output.String(), `ae_source="`); n != 2 {
+			t.Errorf("expected 2 labelled samples from the cache, got %d:\n%s", n, output.String())
+		}
+	}
+	if n := atomic.LoadInt32(&scrapes); n != 1 {
+		t.Errorf("expected target to be scraped once, got %d", n)
+	}
+}
+
+func newFixtureServer(name string) *httptest.Server {
+	fixture := mustReadAll(mustOpenFile(name, os.O_RDONLY))
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, fixture)
+	}))
+}
+
+func TestAggregateMergesHistogramsAndSummaries(t *testing.T) {
+	fixtures := []string{"histogram-summary.txt", "histogram-summary-2.txt"}
+	targets := []*Target{}
+	expected := map[string]map[string]*io_prometheus_client.MetricFamily{}
+	for _, name := range fixtures {
+		server := newFixtureServer(name)
+		defer server.Close()
+		targets = append(targets, &Target{URL: server.URL})
+
+		families, err := getMetricFamilies(mustOpenFile(name, os.O_RDONLY))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[server.URL] = families
+	}
+
+	output := &bytes.Buffer{}
+	(&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate(targets, output, AggregateOptions{})
+
+	merged, err := getMetricFamilies(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"http_request_duration_seconds", "rpc_duration_seconds"} {
+		mf, ok := merged[name]
+		if !ok {
+			t.Fatalf("family %s missing from output", name)
+		}
+		if len(mf.Metric) != len(targets) {
+			t.Fatalf("expected one %s series per target, got %d", name, len(mf.Metric))
+		}
+		for _, m := range mf.Metric {
+			if len(m.Label) != 1 || m.Label[0].GetName() != *targetLabelName {
+				t.Fatalf("expected only the source label on %s, got %v", name, m.Label)
+			}
+			original := expected[m.Label[0].GetValue()][name].Metric[0]
+			if !proto.Equal(original.Histogram, m.Histogram) || !proto.Equal(original.Summary, m.Summary) {
+				t.Errorf("%s from %s was not preserved: expected %v, got %v", name, m.Label[0].GetValue(), original, m)
+			}
+		}
+	}
+}
+
+func TestFetchRetriesEmptyResponses(t *testing.T) {
+	defer func(attempts int) { *targetEmptyAttempts = attempts }(*targetEmptyAttempts)
+	*targetEmptyAttempts = 3
+
+	var scrapes int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&scrapes, 1)
+	}))
+	defer server.Close()
+
+	resultChan := make(chan *Result, 1)
+	(&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).fetch(context.Background(), &Target{URL: server.URL}, resultChan)
+
+	if result := <-resultChan; result.Error == nil {
+		t.Error("expected an empty response to be reported as an error")
+	}
+	if n := atomic.LoadInt32(&scrapes); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+}
+
+func TestFetchDelaysEmptyRetries(t *testing.T) {
+	defer func(attempts int, delay time.Duration) {
+		*targetEmptyAttempts, *targetEmptyDelay = attempts, delay
+	}(*targetEmptyAttempts, *targetEmptyDelay)
+	*targetEmptyAttempts = 3
+
+	var mu sync.Mutex
+	var scrapes []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		scrapes = append(scrapes, time.Now())
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		delay, timeout, min, max time.Duration
+	}{
+		{delay: 20 * time.Millisecond, timeout: time.Second, min: 60 * time.Millisecond, max: time.Second},
+		// The delay is capped at the scrape timeout.
+		{delay: time.Hour, timeout: 50 * time.Millisecond, min: 100 * time.Millisecond, max: time.Second},
+	} {
+		*targetEmptyDelay = test.delay
+		scrapes = nil
+		resultChan := make(chan *Result, 1)
+		(&Aggregator{HTTP: &http.Client{Timeout: test.timeout}}).fetch(context.Background(), &Target{URL: server.URL}, resultChan)
+		<-resultChan
+
+		mu.Lock()
+		if len(scrapes) != 3 {
+			t.Fatalf("expected 3 attempts, got %d", len(scrapes))
+		}
+		if took := scrapes[2].Sub(scrapes[0]); took < test.min || took > test.max {
+			t.Errorf("expected the retries with a delay of %s to take between %s and %s, took %s", test.delay, test.min, test.max, took)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestFetchFallback(t *testing.T) {
+	primary, fallback := newFixtureServer("histogram.txt"), newFixtureServer("histogram.txt")
+	defer fallback.Close()
+	primary.Close()
+
+	target := &Target{URL: primary.URL, Fallback: fallback.URL}
+	resultChan := make(chan *Result, 1)
+	(&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).fetch(context.Background(), target, resultChan)
+
+	result := <-resultChan
+	if result.Error != nil {
+		t.Fatalf("expected the fallback to be scraped, got %s", result.Error.Error())
+	}
+	if result.URL != primary.URL || len(result.MetricFamily) == 0 {
+		t.Errorf("expected metrics reported under %s, got %d families under %s", primary.URL, len(result.MetricFamily), result.URL)
+	}
+}
+
+func TestAggregateSequential(t *testing.T) {
+	targets := []*Target{}
+	for i := 0; i < 5; i++ {
+		server := newFixtureServer("histogram.txt")
+		defer server.Close()
+		targets = append(targets, &Target{URL: server.URL})
+	}
+
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}, Sequential: true}
+	output := &bytes.Buffer{}
+	aggregator.Aggregate(targets, output, AggregateOptions{})
+
+	families, err := getMetricFamilies(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := families["http_requests_total"].Metric
+	for i, target := range targets {
+		for _, m := range metrics[i*2 : i*2+2] {
+			if source := findLabel(m, *targetLabelName).GetValue(); source != target.URL {
+				t.Errorf("expected series %d to be from %s, got %s", i, target.URL, source)
+			}
+		}
+	}
+}
+
+func TestAggregateGroupBySource(t *testing.T) {
+	first, second := newFixtureServer("histogram.txt"), newFixtureServer("histogram-2.txt")
+	defer first.Close()
+	defer second.Close()
+
+	output := &bytes.Buffer{}
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}}
+	aggregator.Aggregate([]*Target{{URL: first.URL}, {URL: second.URL}}, output, AggregateOptions{GroupBySource: true})
+
+	blocks := strings.Split(output.String(), "# source: ")
+	if len(blocks) != 3 || !strings.HasPrefix(blocks[1], first.URL+"\n") || !strings.HasPrefix(blocks[2], second.URL+"\n") {
+		t.Fatalf("expected one block per target in order, got:\n%s", output.String())
+	}
+	for i, server := range []*httptest.Server{first, second} {
+		if n := strings.Count(blocks[i+1], "# TYPE http_requests_total"); n != 1 {
+			t.Errorf("expected http_requests_total once in the block of %s, got %d", server.URL, n)
+		}
+		if strings.Count(blocks[i+1], `ae_source="`) != strings.Count(blocks[i+1], `ae_source="`+server.URL+`"`) {
+			t.Errorf("expected only metrics of %s in its block, got:\n%s", server.URL, blocks[i+1])
+		}
+	}
+}
+
+func TestSampleTargets(t *testing.T) {
+	targets := []*Target{}
+	position := map[*Target]int{}
+	for i := 0; i < 100; i++ {
+		targets = append(targets, &Target{URL: fmt.Sprintf("http://host-%d/metrics", i)})
+		position[targets[i]] = i
+	}
+
+	sampled := sampleTargets(targets, 0.1, 42)
+	if len(sampled) != 10 {
+		t.Fatalf("expected 10 targets, got %d", len(sampled))
+	}
+	again := sampleTargets(targets, 0.1, 42)
+	for i := range sampled {
+		if sampled[i] != again[i] {
+			t.Fatalf("expected the same seed to pick the same targets, got %s and %s", sampled[i].URL, again[i].URL)
+		}
+		if i > 0 && position[sampled[i-1]] >= position[sampled[i]] {
+			t.Errorf("expected sampled targets in their original order, got %s before %s", sampled[i-1].URL, sampled[i].URL)
+		}
+	}
+	if n := len(sampleTargets(targets[:3], 0.01, 42)); n != 1 {
+		t.Errorf("expected at least one target, got %d", n)
+	}
+}
+
+func TestShuffleTargets(t *testing.T) {
+	targets := []*Target{}
+	for i := 0; i < 100; i++ {
+		targets = append(targets, &Target{URL: fmt.Sprintf("http://host-%d/metrics", i)})
+	}
+
+	firsts := map[*Target]bool{}
+	for i := 0; i < 5; i++ {
+		shuffled := shuffleTargets(targets)
+		seen := map[*Target]bool{}
+		for _, target := range shuffled {
+			seen[target] = true
+		}
+		if len(shuffled) != len(targets) || len(seen) != len(targets) {
+			t.Fatalf("expected every target once, got %d of %d", len(seen), len(targets))
+		}
+		firsts[shuffled[0]] = true
+	}
+	if len(firsts) < 2 {
+		t.Error("expected a different order on every shuffle")
+	}
+	if targets[0].URL != "http://host-0/metrics" || targets[99].URL != "http://host-99/metrics" {
+		t.Error("expected the targets given to be left in their order")
+	}
+}
+
+func TestReadTargetList(t *testing.T) {
+	lines, err := readTargetList(strings.NewReader("http://a/metrics\r\n\n  http://b/metrics \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targets := filterEmptyStrings(lines); len(targets) != 2 || targets[0] != "http://a/metrics" || targets[1] != "http://b/metrics" {
+		t.Errorf("unexpected targets read: %q", targets)
+	}
+}
+
+func TestStoreResultGraceWindow(t *testing.T) {
+	defer func(after int) { *targetDownAfter = after }(*targetDownAfter)
+	*targetDownAfter = 3
+
+	target := &Target{URL: "http://a/metrics", Interval: duration(time.Minute)}
+	aggregator := &Aggregator{}
+	failed := &Result{URL: target.URL, Error: fmt.Errorf("connection refused")}
+
+	aggregator.storeResult(target, &Result{URL: target.URL})
+	for i, expectError := range []bool{false, false, true, true} {
+		aggregator.storeResult(target, failed)
+		result, _ := aggregator.cachedResult(target)
+		if (result.Error != nil) != expectError {
+			t.Errorf("after %d failures expected error=%v, got %v", i+1, expectError, result.Error)
+		}
+	}
+
+	aggregator.storeResult(target, &Result{URL: target.URL})
+	aggregator.storeResult(target, failed)
+	if result, _ := aggregator.cachedResult(target); result.Error != nil {
+		t.Errorf("expected a success to reset the failure count, got %v", result.Error)
+	}
+}
+
+func TestAggregateNestedAggregator(t *testing.T) {
+	defer func(strategy string) { *targetLabelConflict = strategy }(*targetLabelConflict)
+	*targetLabelConflict = labelConflictRename
+
+	target := newFixtureServer("histogram.txt")
+	defer target.Close()
+	inner := httptest.NewServer(metricsHandler(&Config{Targets: []*Target{{URL: target.URL}}}, &Aggregator{HTTP: &http.Client{Timeout: time.Second}}))
+	defer inner.Close()
+
+	output := &bytes.Buffer{}
+	(&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate([]*Target{{URL: inner.URL}}, output, AggregateOptions{})
+
+	families, err := getMetricFamilies(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := families["http_requests_total"].GetMetric()
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 series through the inner aggregator, got %d", len(metrics))
+	}
+	for _, m := range metrics {
+		if findLabel(m, "ae_source").GetValue() != target.URL || findLabel(m, "ae_source_2").GetValue() != inner.URL {
+			t.Errorf("expected the inner source label to be kept and the outer one renamed, got %s", labelString(m))
+		}
+	}
+}
+
+func TestAggregateNestedAggregatorScrapeMetrics(t *testing.T) {
+	defer func(enabled, hash bool) { *scrapeMetricsEnabled, *outputHash = enabled, hash }(*scrapeMetricsEnabled, *outputHash)
+	*scrapeMetricsEnabled, *outputHash = true, true
+
+	target := newFixtureServer("histogram.txt")
+	defer target.Close()
+	inner := httptest.NewServer(metricsHandler(&Config{Targets: []*Target{{URL: target.URL}}}, &Aggregator{HTTP: &http.Client{Timeout: time.Second}}))
+	defer inner.Close()
+
+	output := &bytes.Buffer{}
+	if err := (&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate([]*Target{{URL: inner.URL}}, output, AggregateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	families, err := getMetricFamilies(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"ae_up", "ae_scrape_error", "ae_output_hash"} {
+		if n := len(families[name].GetMetric()); n != 2 {
+			t.Errorf("expected %s from both the inner and the outer aggregator, got %d series:\n%s", name, n, output.String())
+		}
+	}
+	for _, m := range families["ae_up"].GetMetric() {
+		if m.Gauge.GetValue() != 1 {
+			t.Errorf("expected both targets to be up, got %s %v", labelString(m), m.Gauge.GetValue())
+		}
+	}
+}
+
+func TestAggregatorWaitWarm(t *testing.T) {
+	delay := int64(50 * time.Millisecond)
+	fixture := mustReadAll(mustOpenFile("histogram.txt", os.O_RDONLY))
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(atomic.LoadInt64(&delay)))
+		io.WriteString(rw, fixture)
+	}))
+	defer server.Close()
+
+	target := &Target{URL: server.URL, Interval: duration(time.Hour)}
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: 2 * time.Second}}
+	if !aggregator.WaitWarm(time.Millisecond) {
+		t.Error("expected an aggregator without background targets to be warm")
+	}
+
+	aggregator.Start([]*Target{target})
+	if !aggregator.WaitWarm(time.Second) {
+		t.Fatal("expected the first background scrape to complete")
+	}
+	if _, ok := aggregator.cachedResult(target); !ok {
+		t.Error("expected the warm-up to leave the result in the cache")
+	}
+
+	atomic.StoreInt64(&delay, int64(300*time.Millisecond))
+	aggregator.Start([]*Target{target})
+	if aggregator.WaitWarm(50 * time.Millisecond) {
+		t.Error("expected the warm-up to give up on a slow target")
+	}
+}
+
+// BenchmarkAggregateSingleTarget measures aggregating one target with many
+// small families, as for /metrics?t=, from the background cache so that the
+// time is spent labelling and encoding rather than scraping.
+func BenchmarkAggregateSingleTarget(b *testing.B) {
+	body := largeExposition(500, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write(body)
+	}))
+	defer server.Close()
+
+	targets := []*Target{{URL: server.URL, Interval: duration(time.Hour)}}
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: 10 * time.Second}}
+	aggregator.Start(targets)
+	if !aggregator.WaitWarm(10 * time.Second) {
+		b.Fatal("background scrape did not complete")
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		aggregator.Aggregate(targets, ioutil.Discard, AggregateOptions{})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// metricNameFilter decides which metric families of a target are aggregated
+// from its metrics_allow and metrics_deny patterns. The patterns are regular
+// expressions matched against the whole metric name, e.g. http_.* for all
+// metrics starting with http_.
+type metricNameFilter struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+// applyMetricNameFilter drops the families of a scraped target that its
+// metrics_allow and metrics_deny patterns exclude. It runs before
+// applyFamilyLimit, so families that are filtered out anyway do not count
+// towards -targets.family.limit.
+func applyMetricNameFilter(result *Result) {
+	for name := range result.MetricFamily {
+		if !result.Target.keepMetric(name) {
+			delete(result.MetricFamily, name)
+		}
+	}
+}
+
+func compileMetricNameFilter(allow, deny []string) (*metricNameFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	filter := &metricNameFilter{}
+	var err error
+	if filter.allow, err = compileNamePatterns(allow); err != nil {
+		return nil, fmt.Errorf("invalid metrics_allow: %s", err.Error())
+	}
+	if filter.deny, err = compileNamePatterns(deny); err != nil {
+		return nil, fmt.Errorf("invalid metrics_deny: %s", err.Error())
+	}
+	return filter, nil
+}
+
+func compileNamePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		regex, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, regex)
+	}
+	return compiled, nil
+}
+
+// keep reports whether the family called name is aggregated: it must match
+// one of the allow patterns, if there are any, and none of the deny patterns.
+func (f *metricNameFilter) keep(name string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.allow) > 0 && !matchesAny(f.allow, name) {
+		return false
+	}
+	return !matchesAny(f.deny, name)
+}
+
+func matchesAny(patterns []*regexp.Regexp, name string) bool {
+	for _, regex := range patterns {
+		if regex.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
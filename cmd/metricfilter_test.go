@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_model/go"
+)
+
+// metricSources returns the source labels of metrics.
+func metricSources(metrics []*io_prometheus_client.Metric) map[string]bool {
+	sources := make(map[string]bool)
+	for _, m := range metrics {
+		sources[findLabel(m, *targetLabelName).GetValue()] = true
+	}
+	return sources
+}
+
+func TestAggregateMetricNameFilters(t *testing.T) {
+	defer func(path string) { *configFile = path }(*configFile)
+
+	allowed, denied := newFixtureServer("histogram-summary.txt"), newFixtureServer("histogram-summary-2.txt")
+	defer allowed.Close()
+	defer denied.Close()
+	*configFile = writeConfigFile(t, fmt.Sprintf(`{"targets": [
+		{"url": %q, "metrics_allow": ["http_.*"]},
+		{"url": %q, "metrics_deny": ["http_.*_seconds"]}
+	]}`, allowed.URL, denied.URL))
+	defer os.Remove(*configFile)
+
+	config, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &bytes.Buffer{}
+	if err := (&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate(config.Targets, output, AggregateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	families, err := getMetricFamilies(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sources := metricSources(families["http_request_duration_seconds"].GetMetric()); len(sources) != 1 || !sources[allowed.URL] {
+		t.Errorf("expected the histogram only from the target allowing it, got %v", sources)
+	}
+	if sources := metricSources(families["rpc_duration_seconds"].GetMetric()); len(sources) != 1 || !sources[denied.URL] {
+		t.Errorf("expected the summary only from the target not denying it, got %v", sources)
+	}
+}
+
+func TestLoadConfigFileInvalidMetricNameFilter(t *testing.T) {
+	path := writeConfigFile(t, `{"targets": [{"url": "http://a/metrics", "metrics_deny": ["("]}]}`)
+	defer os.Remove(path)
+	if _, err := loadConfigFile(path); err == nil {
+		t.Error("expected an invalid metrics_deny pattern to fail")
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// normalizeMetricName rewrites name into snake_case, replacing every
+// character that is not valid in a Prometheus metric name with an underscore
+// e.g. "legacy.requestCount" becomes "legacy_request_count".
+func normalizeMetricName(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		switch {
+		case unicode.IsUpper(r) && r < unicode.MaxASCII:
+			// start a new word at fooBar and at the end of an acronym in HTTPServer
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		case r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9' && i > 0):
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
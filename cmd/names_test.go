@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestNormalizeMetricName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"http_requests_total":   "http_requests_total",
+		"legacy.requestCount":   "legacy_request_count",
+		"HTTPServerRequests":    "http_server_requests",
+		"jvm.gc-pause:seconds":  "jvm_gc_pause:seconds",
+		"0day_count":            "_day_count",
+		"cache.hits2xx.total":   "cache_hits2xx_total",
+		"queue depth (current)": "queue_depth__current_",
+	} {
+		if actual := normalizeMetricName(name); actual != expected {
+			t.Errorf("expected %s to be normalized to %s, got %s", name, expected, actual)
+		}
+	}
+}
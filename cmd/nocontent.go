@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_model/go"
+)
+
+// Ways of handling targets responding 204 No Content for -targets.no-content.
+const (
+	noContentParse   = "parse"
+	noContentSuccess = "success"
+	noContentError   = "error"
+)
+
+func validNoContent(mode string) bool {
+	return mode == noContentParse || mode == noContentSuccess || mode == noContentError
+}
+
+// handleNoContent completes result of a scrape of url that was answered with
+// 204 No Content, which some exporters send when they have nothing to report.
+// It is either a success without any metrics or a failure.
+func handleNoContent(result *Result, url string) *Result {
+	if *targetNoContent == noContentError {
+		result.Error = fmt.Errorf("target %s returned %d %s", url, http.StatusNoContent, http.StatusText(http.StatusNoContent))
+		result.ErrorCategory = errorNoContent
+		return result
+	}
+	result.MetricFamily = map[string]*io_prometheus_client.MetricFamily{}
+	return result
+}
+
+// isAcceptedNoContent reports whether result is a 204 No Content response
+// that counts as a success, which is not retried by -targets.empty.attempts.
+func isAcceptedNoContent(result *Result) bool {
+	return result.StatusCode == http.StatusNoContent && *targetNoContent == noContentSuccess
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNoContent(t *testing.T) {
+	defer func(mode string, attempts int) { *targetNoContent, *targetEmptyAttempts = mode, attempts }(*targetNoContent, *targetEmptyAttempts)
+	*targetEmptyAttempts = 2
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}}
+	target := &Target{URL: server.URL}
+	for mode, category := range map[string]string{
+		noContentParse:   errorEmpty,
+		noContentSuccess: "",
+		noContentError:   errorNoContent,
+	} {
+		*targetNoContent = mode
+		result := aggregator.scrapeUntilNotEmpty(target, target.URL)
+		if result.ErrorCategory != category || (category == "") != (result.Error == nil) {
+			t.Errorf("expected category %q with -targets.no-content=%s, got %q and error %v", category, mode, result.ErrorCategory, result.Error)
+		}
+		if result.StatusCode != http.StatusNoContent || len(result.MetricFamily) != 0 {
+			t.Errorf("expected a 204 without metrics with -targets.no-content=%s, got %d and %v", mode, result.StatusCode, result.MetricFamily)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_model/go"
+)
+
+// errParseDeadline is returned once a target response took longer than
+// -targets.parse.timeout to parse.
+var errParseDeadline = errors.New("parse deadline exceeded")
+
+// deadlineReader fails reads after deadline. The parser cannot be cancelled
+// but stops at its next read, so a huge body does not keep a fetch going long
+// after the scrape should have given up. The parser treats a read error at the
+// start of a line like the end of the input, so check exceeded afterwards
+// instead of relying on the error being returned.
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+	exceeded bool
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if d.exceeded || time.Now().After(d.deadline) {
+		d.exceeded = true
+		return 0, errParseDeadline
+	}
+	n, err := d.r.Read(p)
+	// The read may have blocked past the deadline.
+	if time.Now().After(d.deadline) {
+		d.exceeded = true
+		return 0, errParseDeadline
+	}
+	return n, err
+}
+
+// unexpectedContentType returns the media type of a response that is clearly
+// not an exposition format, such as the HTML of a login page. A missing or
+// unknown Content-Type is not reported since many targets do not set it.
+func unexpectedContentType(header http.Header) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return "", false
+	}
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "application/json", "application/xml", "text/xml":
+		return mediaType, true
+	}
+	return mediaType, false
+}
+
+// parseResponse parses the body of a target response, giving up after
+// -targets.parse.timeout. exceeded reports whether the timeout was hit, in
+// which case the families are incomplete. With a timeout the body is read into
+// memory first so that a target that is slow to send its response is left to
+// the scrape timeout instead of counting against the parse.
+func parseResponse(body io.Reader) (families map[string]*io_prometheus_client.MetricFamily, exceeded bool, err error) {
+	if *targetParseTimeout > 0 {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, false, err
+		}
+		body = bytes.NewReader(data)
+	}
+	return parseBody(body)
+}
+
+// parseBody parses body as it is read, with the deadline starting now.
+func parseBody(body io.Reader) (families map[string]*io_prometheus_client.MetricFamily, exceeded bool, err error) {
+	read := &readErrorReader{r: body}
+	body = read
+	var deadline *deadlineReader
+	if *targetParseTimeout > 0 {
+		deadline = &deadlineReader{r: body, deadline: time.Now().Add(time.Duration(*targetParseTimeout) * time.Millisecond)}
+		body = deadline
+	}
+	if *targetReadBufferSize > 0 {
+		body = bufio.NewReaderSize(body, *targetReadBufferSize)
+	}
+	families, err = getMetricFamilies(body)
+	if err == nil && read.err != nil {
+		return nil, deadline != nil && deadline.exceeded, read.err
+	}
+	return families, deadline != nil && deadline.exceeded, err
+}
+
+// readErrorReader remembers the first error reading r other than io.EOF. Like
+// errParseDeadline, the parser takes an error at the start of a line for the
+// end of the input, which would turn a response cut off by a timeout into a
+// successful scrape of whatever came before.
+type readErrorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// parsePool parses responses with -targets.parse.workers goroutines. Scrapes
+// read their response into memory and hand it to the pool, so a scrape does
+// not hold on to its connection while waiting for CPU behind other parses.
+type parsePool struct {
+	once sync.Once
+	jobs chan *parseJob
+}
+
+type parseJob struct {
+	body []byte
+	done chan *parseResult
+}
+
+type parseResult struct {
+	families map[string]*io_prometheus_client.MetricFamily
+	exceeded bool
+	err      error
+}
+
+// parse reads body and waits for one of the workers to parse it.
+func (p *parsePool) parse(body io.Reader) (map[string]*io_prometheus_client.MetricFamily, bool, error) {
+	p.once.Do(func() {
+		p.jobs = make(chan *parseJob)
+		for i := 0; i < *targetParseWorkers; i++ {
+			go p.work()
+		}
+	})
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, false, err
+	}
+	job := &parseJob{body: b, done: make(chan *parseResult, 1)}
+	p.jobs <- job
+	result := <-job.done
+	return result.families, result.exceeded, result.err
+}
+
+func (p *parsePool) work() {
+	for job := range p.jobs {
+		families, exceeded, err := parseBody(bytes.NewReader(job.body))
+		job.done <- &parseResult{families: families, exceeded: exceeded, err: err}
+	}
+}
+
+// readPartialBody reads all of body for -targets.partial. If the scrape times
+// out while reading, whatever was received is returned with truncated set.
+// The last family of it may be incomplete, e.g. a histogram without its +Inf
+// bucket, so the data is cut before the TYPE line of that family.
+func readPartialBody(body io.Reader) (data []byte, truncated bool, err error) {
+	data, err = ioutil.ReadAll(body)
+	if err == nil || classifyError(err, "") != errorTimeout {
+		return data, false, err
+	}
+	if bytes.HasPrefix(data, []byte("# TYPE ")) && bytes.Count(data, []byte("\n# TYPE ")) == 0 {
+		return nil, true, nil
+	}
+	if i := bytes.LastIndex(data, []byte("\n# TYPE ")); i >= 0 {
+		return data[:i+1], true, nil
+	}
+	return data[:bytes.LastIndexByte(data, '\n')+1], true, nil
+}
+
+// dropEmptyFamilies removes families without samples, such as the HELP line
+// of a family that was cut off by readPartialBody.
+func dropEmptyFamilies(families map[string]*io_prometheus_client.MetricFamily) {
+	for name, mf := range families {
+		if len(mf.Metric) == 0 {
+			delete(families, name)
+		}
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
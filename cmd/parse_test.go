@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func largeExposition(families, series int) []byte {
+	buf := &bytes.Buffer{}
+	for f := 0; f < families; f++ {
+		fmt.Fprintf(buf, "# HELP family_%d_total A generated counter.\n# TYPE family_%d_total counter\n", f, f)
+		for s := 0; s < series; s++ {
+			fmt.Fprintf(buf, "family_%d_total{instance=\"host-%d:9100\",path=\"/api/v1/resource/%d\"} %d\n", f, s, s, s*f)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestScrapeParseTimeout(t *testing.T) {
+	defer func(timeout int) { *targetParseTimeout = timeout }(*targetParseTimeout)
+	*targetParseTimeout = 1
+
+	body := largeExposition(1000, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write(body)
+	}))
+	defer server.Close()
+
+	target := &Target{URL: server.URL}
+	result := (&Aggregator{HTTP: &http.Client{Timeout: 10 * time.Second}}).scrape(target, target.URL)
+	if result.Error == nil || result.ErrorCategory != errorTimeout {
+		t.Errorf("expected a slow parse to fail with a timeout, got %v (%s)", result.Error, result.ErrorCategory)
+	}
+}
+
+func TestScrapeParseTimeoutExcludesDownload(t *testing.T) {
+	defer func(timeout int) { *targetParseTimeout = timeout }(*targetParseTimeout)
+	*targetParseTimeout = 20
+
+	body := largeExposition(10, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write(body[:len(body)/2])
+		rw.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		rw.Write(body[len(body)/2:])
+	}))
+	defer server.Close()
+
+	target := &Target{URL: server.URL}
+	result := (&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).scrape(target, target.URL)
+	if result.Error != nil {
+		t.Errorf("expected a slow download to be left to the scrape timeout, got %v", result.Error)
+	}
+	if len(result.MetricFamily) != 10 {
+		t.Errorf("expected all 10 families, got %d", len(result.MetricFamily))
+	}
+}
+
+func TestScrapePartial(t *testing.T) {
+	defer func(enabled bool) { *targetPartial = enabled }(*targetPartial)
+	*targetPartial = true
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "# HELP a_total Complete.\n# TYPE a_total counter\na_total 1\n# HELP b Cut off.\n# TYPE b histogram\nb_bucket{le=\"1\"} 1\n")
+		rw.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(rw, "b_bucket{le=\"+Inf\"} 2\nb_sum 3\nb_count 2\n")
+	}))
+	defer server.Close()
+
+	target := &Target{URL: server.URL}
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: 50 * time.Millisecond}}
+	result := aggregator.scrape(target, target.URL)
+	if result.Error != nil || !result.Partial {
+		t.Fatalf("expected a partial result, got %v", result.Error)
+	}
+	if len(result.MetricFamily) != 1 || result.MetricFamily["a_total"] == nil {
+		t.Errorf("expected only the complete family to be kept, got %v", result.MetricFamily)
+	}
+
+	*targetPartial = false
+	if result := aggregator.scrape(target, target.URL); result.Error == nil {
+		t.Error("expected the timeout to fail the scrape without -targets.partial")
+	}
+}
+
+func TestReadPartialBody(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}
+	for data, expected := range map[string]string{
+		"# TYPE a gauge\na 1\n# TYPE b gauge\nb 1\n": "# TYPE a gauge\na 1\n",
+		"# TYPE a gauge\na 1\n":                      "",
+		"a 1\nb 1\nc":                                "a 1\nb 1\n",
+		"a 1":                                        "",
+	} {
+		kept, truncated, err := readPartialBody(io.MultiReader(strings.NewReader(data), iotest.ErrReader(timeout)))
+		if err != nil || !truncated || string(kept) != expected {
+			t.Errorf("expected %q to be cut to %q, got %q (truncated %v, %v)", data, expected, kept, truncated, err)
+		}
+	}
+	if _, truncated, err := readPartialBody(io.MultiReader(strings.NewReader("a 1\n"), iotest.ErrReader(io.ErrUnexpectedEOF))); err == nil || truncated {
+		t.Error("expected read errors other than timeouts to be returned")
+	}
+}
+
+func TestScrapeUnexpectedContentType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.Write([]byte("<html><body>Please log in</body></html>"))
+	}))
+	defer server.Close()
+
+	target := &Target{URL: server.URL}
+	result := (&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).scrape(target, target.URL)
+	if result.Error == nil || !strings.Contains(result.Error.Error(), "returned text/html, not metrics") {
+		t.Errorf("expected a descriptive error for an HTML response, got %v", result.Error)
+	}
+}
+
+func TestScrapeParseWorkers(t *testing.T) {
+	defer func(workers int) { *targetParseWorkers = workers }(*targetParseWorkers)
+	*targetParseWorkers = 2
+
+	targets := []*Target{}
+	for i := 0; i < 5; i++ {
+		server := newFixtureServer("histogram.txt")
+		defer server.Close()
+		targets = append(targets, &Target{URL: server.URL})
+	}
+
+	output := &bytes.Buffer{}
+	(&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate(targets, output, AggregateOptions{})
+
+	families, err := getMetricFamilies(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(families["http_requests_total"].GetMetric()); n != 10 {
+		t.Errorf("expected 10 http_requests_total series from 5 targets, got %d", n)
+	}
+}
+
+// BenchmarkAggregateParseWorkers compares parsing each response while it is
+// read (workers=0) to a pool of -targets.parse.workers for many targets with
+// large responses.
+func BenchmarkAggregateParseWorkers(b *testing.B) {
+	defer func(workers int) { *targetParseWorkers = workers }(*targetParseWorkers)
+
+	body := largeExposition(20, 250)
+	targets := []*Target{}
+	for i := 0; i < 20; i++ {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write(body)
+		}))
+		defer server.Close()
+		targets = append(targets, &Target{URL: server.URL})
+	}
+
+	for _, workers := range []int{0, 1, 2, 4, 8} {
+		*targetParseWorkers = workers
+		aggregator := &Aggregator{HTTP: &http.Client{Timeout: 10 * time.Second}}
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(body) * len(targets)))
+			for i := 0; i < b.N; i++ {
+				aggregator.Aggregate(targets, ioutil.Discard, AggregateOptions{})
+			}
+		})
+	}
+}
+
+// BenchmarkGetMetricFamilies compares parsing with the parser's own 4096 byte
+// buffer (size 0) to larger buffers given with -targets.read.buffer.size.
+func BenchmarkGetMetricFamilies(b *testing.B) {
+	body := largeExposition(100, 500)
+	for _, size := range []int{0, 16384, 65536, 262144} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				var r io.Reader = bytes.NewReader(body)
+				if size > 0 {
+					r = bufio.NewReaderSize(r, size)
+				}
+				if _, err := getMetricFamilies(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
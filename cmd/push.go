@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// pusher pushes the aggregated metrics to a Pushgateway for -push.url. With a
+// -push.collect.interval the targets are aggregated more often than they are
+// pushed and the latest sample of every series seen since the last push is
+// sent, so a series missing from one aggregation is not lost while the number
+// of pushes stays low.
+type pusher struct {
+	config     *Config
+	aggregator *Aggregator
+	client     *http.Client
+	url        string
+
+	window pushWindow
+}
+
+func (p *pusher) run() {
+	pushTicker := time.NewTicker(*pushInterval)
+	defer pushTicker.Stop()
+
+	var collect <-chan time.Time
+	if *pushCollectInterval > 0 {
+		collectTicker := time.NewTicker(*pushCollectInterval)
+		defer collectTicker.Stop()
+		collect = collectTicker.C
+	}
+
+	for {
+		select {
+		case <-collect:
+			p.collect()
+		case <-pushTicker.C:
+			if collect == nil {
+				p.collect()
+			}
+			if err := p.push(); err != nil {
+				pushFailures.Inc()
+				log.Printf("Push to %s failed: %s", p.url, err.Error())
+			}
+		}
+	}
+}
+
+// collect aggregates the targets and adds the result to the window.
+func (p *pusher) collect() {
+	buf := &bytes.Buffer{}
+	if err := p.aggregator.Aggregate(p.config.currentTargets(), buf, AggregateOptions{Format: expfmt.FmtProtoDelim}); err != nil {
+		log.Printf("Aggregation for push failed: %s", err.Error())
+		return
+	}
+	decoder := expfmt.NewDecoder(buf, expfmt.FmtProtoDelim)
+	for {
+		mf := &io_prometheus_client.MetricFamily{}
+		if err := decoder.Decode(mf); err == io.EOF {
+			return
+		} else if err != nil {
+			log.Printf("Aggregation for push failed: %s", err.Error())
+			return
+		}
+		p.window.add(mf)
+	}
+}
+
+// push sends the window to the Pushgateway, replacing what it had for the
+// group, and starts a new window.
+func (p *pusher) push() error {
+	families := p.window.take()
+	if len(families) == 0 {
+		return nil
+	}
+	body := &bytes.Buffer{}
+	if err := encodeMetricFamilies(body, families, expfmt.FmtText); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, p.url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtText))
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// pushWindow keeps the latest sample of every series added since it was last
+// taken.
+type pushWindow struct {
+	families map[string]*io_prometheus_client.MetricFamily
+	series   map[string]map[string]int
+}
+
+// add merges mf into the window, replacing the samples of series that are
+// already in it.
+func (w *pushWindow) add(mf *io_prometheus_client.MetricFamily) {
+	if w.families == nil {
+		w.families = make(map[string]*io_prometheus_client.MetricFamily)
+		w.series = make(map[string]map[string]int)
+	}
+	existing, ok := w.families[mf.GetName()]
+	if !ok || existing.GetType() != mf.GetType() {
+		w.families[mf.GetName()] = mf
+		index := make(map[string]int, len(mf.Metric))
+		for i, m := range mf.Metric {
+			index[labelSetKey(m.Label)] = i
+		}
+		w.series[mf.GetName()] = index
+		return
+	}
+
+	index := w.series[mf.GetName()]
+	for _, m := range mf.Metric {
+		key := labelSetKey(m.Label)
+		if i, ok := index[key]; ok {
+			existing.Metric[i] = m
+			continue
+		}
+		index[key] = len(existing.Metric)
+		existing.Metric = append(existing.Metric, m)
+	}
+}
+
+// take returns the families of the window and empties it.
+func (w *pushWindow) take() map[string]*io_prometheus_client.MetricFamily {
+	families := w.families
+	w.families, w.series = nil, nil
+	return families
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPusherWindow(t *testing.T) {
+	defer func(enabled bool) { *targetLabelsEnabled = enabled }(*targetLabelsEnabled)
+	*targetLabelsEnabled = false
+
+	var scrapes int32
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&scrapes, 1) == 1 {
+			io.WriteString(rw, "# TYPE jobs gauge\njobs{queue=\"a\"} 1\njobs{queue=\"b\"} 1\n")
+			return
+		}
+		io.WriteString(rw, "# TYPE jobs gauge\njobs{queue=\"a\"} 2\n")
+	}))
+	defer target.Close()
+
+	var pushed string
+	var method string
+	gateway := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		method, pushed = r.Method, string(body)
+	}))
+	defer gateway.Close()
+
+	p := &pusher{
+		config:     &Config{Targets: []*Target{{URL: target.URL}}},
+		aggregator: &Aggregator{HTTP: &http.Client{Timeout: time.Second}},
+		client:     &http.Client{Timeout: time.Second},
+		url:        gateway.URL + "/metrics/job/aggregate",
+	}
+	p.collect()
+	p.collect()
+	if err := p.push(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "# TYPE jobs gauge\njobs{queue=\"a\"} 2\njobs{queue=\"b\"} 1\n"; method != http.MethodPut || pushed != expected {
+		t.Errorf("expected a PUT of the latest sample of each series:\n%s\ngot %s:\n%s", expected, method, pushed)
+	}
+
+	pushed = ""
+	if err := p.push(); err != nil || pushed != "" {
+		t.Errorf("expected an empty window not to be pushed, got %q (%v)", pushed, err)
+	}
+
+	gateway.Config.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.Error(rw, "push rejected", http.StatusBadRequest)
+	})
+	p.collect()
+	if err := p.push(); err == nil || !strings.Contains(err.Error(), "push rejected") {
+		t.Errorf("expected the error of the Pushgateway, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// labelReplaceRule works like the replace action of Prometheus relabeling: if
+// the value of SourceLabel matches Regex, TargetLabel is set to Replacement
+// with the capture groups of the match expanded.
+type labelReplaceRule struct {
+	SourceLabel string `json:"source_label"`
+	Regex       string `json:"regex"`
+	TargetLabel string `json:"target_label"`
+
+	// Replacement defaults to "$1". An empty result removes TargetLabel.
+	Replacement *string `json:"replacement"`
+
+	regex *regexp.Regexp
+}
+
+func (r *labelReplaceRule) compile() error {
+	if !model.LabelName(r.SourceLabel).IsValid() {
+		return errors.New("source_label must be a valid label name")
+	}
+	if !model.LabelName(r.TargetLabel).IsValid() {
+		return errors.New("target_label must be a valid label name")
+	}
+	regex, err := regexp.Compile("^(?:" + r.Regex + ")$")
+	if err != nil {
+		return err
+	}
+	r.regex = regex
+	if r.Replacement == nil {
+		r.Replacement = proto.String("$1")
+	}
+	return nil
+}
+
+// apply rewrites the labels of m. A missing source label has an empty value.
+func (r *labelReplaceRule) apply(m *io_prometheus_client.Metric) {
+	value := findLabel(m, r.SourceLabel).GetValue()
+	match := r.regex.FindStringSubmatchIndex(value)
+	if match == nil {
+		return
+	}
+	replaced := string(r.regex.ExpandString(nil, *r.Replacement, value, match))
+
+	for i, label := range m.Label {
+		if label.GetName() != r.TargetLabel {
+			continue
+		}
+		if replaced == "" {
+			m.Label = append(m.Label[:i], m.Label[i+1:]...)
+		} else {
+			m.Label[i] = &io_prometheus_client.LabelPair{Name: label.Name, Value: proto.String(replaced)}
+		}
+		return
+	}
+	if replaced != "" {
+		m.Label = append(m.Label, &io_prometheus_client.LabelPair{Name: proto.String(r.TargetLabel), Value: proto.String(replaced)})
+	}
+}
+
+// applyLabelReplace applies rules in order to every metric of families.
+func applyLabelReplace(families map[string]*io_prometheus_client.MetricFamily, rules []*labelReplaceRule) {
+	if len(rules) == 0 {
+		return
+	}
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			for _, rule := range rules {
+				rule.apply(m)
+			}
+		}
+	}
+}
+
+func (f *Aggregator) setLabelReplaceRules(rules []*labelReplaceRule) {
+	f.labelReplaceMu.Lock()
+	defer f.labelReplaceMu.Unlock()
+	f.labelReplace = rules
+}
+
+func (f *Aggregator) labelReplaceRules() []*labelReplaceRule {
+	f.labelReplaceMu.RLock()
+	defer f.labelReplaceMu.RUnlock()
+	return f.labelReplace
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_model/go"
+)
+
+func TestApplyLabelReplace(t *testing.T) {
+	service := &labelReplaceRule{SourceLabel: "ae_source", Regex: `https?://([^.:/]+).*`, TargetLabel: "service"}
+	dropCode := &labelReplaceRule{SourceLabel: "code", Regex: "200", TargetLabel: "code", Replacement: proto.String("")}
+	for _, rule := range []*labelReplaceRule{service, dropCode} {
+		if err := rule.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct{ code, source, expected string }{
+		{"200", "http://payments.internal:9100/metrics", "ae_source=http://payments.internal:9100/metrics,service=payments,"},
+		{"500", "unix:///tmp/metrics.sock", "code=500,ae_source=unix:///tmp/metrics.sock,"},
+	} {
+		mf := labelledFamily("code", test.code, "ae_source", test.source)
+		applyLabelReplace(map[string]*io_prometheus_client.MetricFamily{"test": mf}, []*labelReplaceRule{service, dropCode})
+		if labelString(mf.Metric[0]) != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, labelString(mf.Metric[0]))
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// reloader reloads the targets and label_replace rules from -config.file on
+// SIGHUP or a POST to /-/reload. Targets given with -targets are kept as they
+// were at startup and those of -targets.command and -targets.url are the ones
+// they last returned.
+type reloader struct {
+	mu         sync.Mutex
+	config     *Config
+	aggregator *Aggregator
+	targetURLs []string
+	sources    []targetSource
+}
+
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lastReloadTimestamp.SetToCurrentTime()
+	urls := r.targetURLs
+	if len(r.sources) > 0 {
+		urls = append([]string{}, urls...)
+		for _, source := range r.sources {
+			urls = append(urls, source.current()...)
+		}
+	}
+	loaded, err := loadConfig(urls)
+	if err != nil {
+		lastReloadSuccess.Set(0)
+		return err
+	}
+	r.config.setTargets(loaded.Targets)
+	r.aggregator.setLabelReplaceRules(loaded.LabelReplace)
+	r.aggregator.Start(loaded.Targets)
+	lastReloadSuccess.Set(1)
+
+	log.Printf("Reloaded config with %d targets", len(loaded.Targets))
+	return nil
+}
+
+func (r *reloader) reloadOnSignal(signals <-chan os.Signal) {
+	for range signals {
+		if err := r.reload(); err != nil {
+			log.Printf("Reload failed, keeping the previous targets: %s", err.Error())
+		}
+	}
+}
+
+func (r *reloader) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.reload(); err != nil {
+		log.Printf("Reload failed, keeping the previous targets: %s", err.Error())
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// movedTargets pairs the targets of the previous Start with the ones that
+// replace them by name and URL, since a reload loads every target anew. The
+// state kept per target, such as circuit breakers, adaptive timeouts, ETags
+// and history, is moved to the replacements and that of removed targets is
+// dropped.
+func movedTargets(previous, targets []*Target) map[*Target]*Target {
+	byKey := make(map[string]*Target, len(targets))
+	for _, target := range targets {
+		byKey[target.stateKey()] = target
+	}
+	moved := make(map[*Target]*Target, len(previous))
+	for _, target := range previous {
+		if replacement, ok := byKey[target.stateKey()]; ok {
+			moved[target] = replacement
+		}
+	}
+	return moved
+}
+
+// retarget moves the state of the targets in moved to their replacements,
+// other than the cache, see retargetCache.
+func (f *Aggregator) retarget(moved map[*Target]*Target) {
+	f.breakers.retarget(moved)
+	f.timeouts.retarget(moved)
+	f.lastSuccesses.retarget(moved)
+	f.lastErrors.retarget(moved)
+	f.history.retarget(moved)
+	f.conditional.retarget(moved)
+	f.lastGood.retarget(moved)
+}
+
+// retargetCache moves the cached background scrapes of the targets in moved
+// to their replacements that are still scraped in the background, so they
+// are served until the replacement is first scraped. f.cacheMu must be held.
+func (f *Aggregator) retargetCache(moved map[*Target]*Target) {
+	cache := make(map[*Target]*Result, len(f.cache))
+	failures := make(map[*Target]int, len(f.failures))
+	for target, result := range f.cache {
+		replacement, ok := moved[target]
+		if !ok || replacement.Interval <= 0 {
+			continue
+		}
+		copied := *result
+		copied.Target = replacement
+		cache[replacement] = &copied
+		if n, ok := f.failures[target]; ok {
+			failures[replacement] = n
+		}
+	}
+	f.cache, f.failures = cache, failures
+}
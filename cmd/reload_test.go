@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	defer func(path string) { *configFile = path }(*configFile)
+	*configFile = writeConfigFile(t, `{"targets": [{"url": "http://a/metrics"}, {"url": "http://b/metrics"}]}`)
+	defer os.Remove(*configFile)
+
+	config := &Config{Targets: []*Target{{URL: "http://a/metrics"}}}
+	r := &reloader{config: config, aggregator: &Aggregator{HTTP: &http.Client{Timeout: time.Second}}}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/-/reload", nil))
+	if rec.Code != http.StatusOK || len(config.currentTargets()) != 2 {
+		t.Fatalf("expected reload to load 2 targets, got %d with %d targets", rec.Code, len(config.currentTargets()))
+	}
+	if success := gatherSelfMetric(t, "ae_config_last_reload_success").Metric[0].Gauge.GetValue(); success != 1 {
+		t.Errorf("expected ae_config_last_reload_success 1, got %v", success)
+	}
+
+	if err := ioutil.WriteFile(*configFile, []byte(`{"targets": [{"interval": "15s"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/-/reload", nil))
+	if rec.Code != http.StatusInternalServerError || len(config.currentTargets()) != 2 {
+		t.Errorf("expected failed reload to keep the 2 targets, got %d with %d targets", rec.Code, len(config.currentTargets()))
+	}
+	if success := gatherSelfMetric(t, "ae_config_last_reload_success").Metric[0].Gauge.GetValue(); success != 0 {
+		t.Errorf("expected ae_config_last_reload_success 0, got %v", success)
+	}
+	if timestamp := gatherSelfMetric(t, "ae_config_last_reload_timestamp_seconds").Metric[0].Gauge.GetValue(); timestamp < float64(time.Now().Add(-time.Minute).Unix()) {
+		t.Errorf("expected a recent reload timestamp, got %v", timestamp)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/-/reload", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestReloadKeepsTargetState(t *testing.T) {
+	defer func(path string, failures int, cooldown time.Duration) {
+		*configFile, *targetBreakerFailures, *targetBreakerCooldown = path, failures, cooldown
+	}(*configFile, *targetBreakerFailures, *targetBreakerCooldown)
+	*targetBreakerFailures, *targetBreakerCooldown = 1, time.Hour
+
+	*configFile = writeConfigFile(t, `{"targets": [{"url": "http://127.0.0.1:1/a"}, {"url": "http://127.0.0.1:1/b"}]}`)
+	defer os.Remove(*configFile)
+	config := &Config{}
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}}
+	r := &reloader{config: config, aggregator: aggregator}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range config.currentTargets() {
+		resultChan := make(chan *Result, 1)
+		aggregator.fetch(context.Background(), target, resultChan)
+		<-resultChan
+	}
+
+	if err := ioutil.WriteFile(*configFile, []byte(`{"targets": [{"url": "http://127.0.0.1:1/a"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	target := config.currentTargets()[0]
+	if aggregator.breakers.allow(target) {
+		t.Error("expected the open breaker of the target to survive the reload")
+	}
+	if _, ok := aggregator.lastErrors.categories[target]; !ok || len(aggregator.lastErrors.categories) != 1 {
+		t.Errorf("expected only the last error of the remaining target to be kept, got %v", aggregator.lastErrors.categories)
+	}
+	if n := len(aggregator.breakers.states); n != 1 {
+		t.Errorf("expected the breaker of the removed target to be dropped, got %d states", n)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// States of labelValueSanitizer.
+const (
+	sanitizeLineStart = iota
+	sanitizeComment
+	sanitizeSample
+	sanitizeLabels
+	sanitizeLabelValue
+)
+
+// labelValueSanitizer repairs label values that the text parser rejects for
+// -targets.parse.sanitize, so one broken series does not fail the whole
+// scrape. Within quoted label values it escapes new lines, quotes that do not
+// end the value and backslashes that do not start a valid escape sequence,
+// and strips other control characters. Everything outside of label values,
+// including comments, is passed on as it is.
+type labelValueSanitizer struct {
+	r       *bufio.Reader
+	state   int
+	pending bytes.Buffer
+}
+
+func newLabelValueSanitizer(r io.Reader) *labelValueSanitizer {
+	return &labelValueSanitizer{r: bufio.NewReader(r)}
+}
+
+func (s *labelValueSanitizer) Read(p []byte) (int, error) {
+	for s.pending.Len() < len(p) {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			if s.pending.Len() > 0 {
+				break
+			}
+			return 0, err
+		}
+		s.sanitize(b)
+		// Return what has been read rather than block for more.
+		if s.r.Buffered() == 0 && s.pending.Len() > 0 {
+			break
+		}
+	}
+	return s.pending.Read(p)
+}
+
+func (s *labelValueSanitizer) sanitize(b byte) {
+	switch s.state {
+	case sanitizeLineStart:
+		switch b {
+		case '#':
+			s.state = sanitizeComment
+		case '\n':
+		case '{':
+			s.state = sanitizeLabels
+		default:
+			s.state = sanitizeSample
+		}
+	case sanitizeComment, sanitizeSample:
+		if b == '\n' {
+			s.state = sanitizeLineStart
+		} else if b == '{' && s.state == sanitizeSample {
+			s.state = sanitizeLabels
+		}
+	case sanitizeLabels:
+		switch b {
+		case '"':
+			s.state = sanitizeLabelValue
+		case '}':
+			s.state = sanitizeSample
+		case '\n':
+			s.state = sanitizeLineStart
+		}
+	case sanitizeLabelValue:
+		s.sanitizeLabelValue(b)
+		return
+	}
+	s.pending.WriteByte(b)
+}
+
+func (s *labelValueSanitizer) sanitizeLabelValue(b byte) {
+	switch {
+	case b == '\\':
+		if next, err := s.r.Peek(1); err == nil && (next[0] == '\\' || next[0] == '"' || next[0] == 'n') {
+			s.r.ReadByte()
+			s.pending.WriteByte(b)
+			s.pending.WriteByte(next[0])
+			return
+		}
+		s.pending.WriteString(`\\`)
+	case b == '"':
+		if s.endsLabelValue() {
+			s.state = sanitizeLabels
+			s.pending.WriteByte(b)
+			return
+		}
+		s.pending.WriteString(`\"`)
+	case b == '\n':
+		s.pending.WriteString(`\n`)
+	case b < 0x20 && b != '\t' || b == 0x7f:
+	default:
+		s.pending.WriteByte(b)
+	}
+}
+
+// endsLabelValue reports whether a quote just read is followed by the next
+// label or the end of the labels rather than more of the value.
+func (s *labelValueSanitizer) endsLabelValue() bool {
+	for n := 1; ; n++ {
+		next, err := s.r.Peek(n)
+		if len(next) < n {
+			return err != nil
+		}
+		switch next[n-1] {
+		case ' ', '\t':
+			continue
+		case ',', '}':
+			return true
+		default:
+			return false
+		}
+	}
+}
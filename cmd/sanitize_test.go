@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestLabelValueSanitizer(t *testing.T) {
+	for input, expected := range map[string]string{
+		"# HELP m A \"quoted\" help.\nm{a=\"b\"} 1\n":         "# HELP m A \"quoted\" help.\nm{a=\"b\"} 1\n",
+		"m{a=\"line\nbreak\"} 1\n":                            "m{a=\"line\\nbreak\"} 1\n",
+		"m{a=\"say \"hi\"\", b=\"c\"} 1\n":                    "m{a=\"say \\\"hi\\\"\", b=\"c\"} 1\n",
+		"m{a=\"C:\\path\\n\"} 1\n":                            "m{a=\"C:\\\\path\\n\"} 1\n",
+		"m{a=\"bell\x07\x00\"} 1\n":                           "m{a=\"bell\"} 1\n",
+		"m{a=\"tab\there\"} 1\nn 2\n":                         "m{a=\"tab\there\"} 1\nn 2\n",
+		"{__name__=\"m\",a=\"x\ny\"} 1\n":                     "{__name__=\"m\",a=\"x\\ny\"} 1\n",
+		"m{a=\"ok\"} 1\nm{a=\"end\"quote\"} 2\nn{a=\"\"} 3\n": "m{a=\"ok\"} 1\nm{a=\"end\\\"quote\"} 2\nn{a=\"\"} 3\n",
+	} {
+		for name, r := range map[string]func() *labelValueSanitizer{
+			"whole": func() *labelValueSanitizer { return newLabelValueSanitizer(strings.NewReader(input)) },
+			"one byte": func() *labelValueSanitizer {
+				return newLabelValueSanitizer(iotest.OneByteReader(strings.NewReader(input)))
+			},
+		} {
+			b, err := ioutil.ReadAll(r())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != expected {
+				t.Errorf("%s: expected %q for %q, got %q", name, expected, input, b)
+			}
+		}
+	}
+}
+
+func TestGetMetricFamiliesSanitize(t *testing.T) {
+	defer func(sanitize bool) { *targetParseSanitize = sanitize }(*targetParseSanitize)
+
+	input := "# TYPE m gauge\nm{a=\"line\nbreak\"} 1\nm{a=\"ok\"} 2\n"
+	if _, err := getMetricFamilies(strings.NewReader(input)); err == nil {
+		t.Fatal("expected the raw new line to fail parsing")
+	}
+	*targetParseSanitize = true
+	families, err := getMetricFamilies(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(families["m"].GetMetric()); n != 2 {
+		t.Fatalf("expected 2 metrics, got %d", n)
+	}
+	if value := families["m"].Metric[0].Label[0].GetValue(); value != "line\nbreak" {
+		t.Errorf("expected the new line to be kept in the value, got %q", value)
+	}
+}
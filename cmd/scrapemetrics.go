@@ -0,0 +1,226 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_model/go"
+)
+
+// addScrapeMetrics adds ae_up and ae_scrape_error series describing how the
+// scrape of each target went, much like the up series Prometheus records, and
+// ae_last_scrape_timestamp_seconds for targets that have been scraped
+// successfully before. ae_scrape_response_bytes is the size of the response
+// of every target that answered. With -targets.scrape.metrics.last-error
+// targets that have failed before also get ae_scrape_last_error.
+func addScrapeMetrics(families map[string]*io_prometheus_client.MetricFamily, results []*Result) {
+	up := &io_prometheus_client.MetricFamily{
+		Name: proto.String("ae_up"),
+		Help: proto.String("1 if the target was scraped successfully, 0 otherwise."),
+		Type: io_prometheus_client.MetricType_GAUGE.Enum(),
+	}
+	scrapeError := &io_prometheus_client.MetricFamily{
+		Name: proto.String("ae_scrape_error"),
+		Help: proto.String("1 if scraping the target failed, 0 otherwise. Failures have a category label saying why."),
+		Type: io_prometheus_client.MetricType_GAUGE.Enum(),
+	}
+	lastScrape := &io_prometheus_client.MetricFamily{
+		Name: proto.String("ae_last_scrape_timestamp_seconds"),
+		Help: proto.String("When the target was last scraped successfully."),
+		Type: io_prometheus_client.MetricType_GAUGE.Enum(),
+	}
+	responseBytes := &io_prometheus_client.MetricFamily{
+		Name: proto.String("ae_scrape_response_bytes"),
+		Help: proto.String("Size of the response body of the target in bytes."),
+		Type: io_prometheus_client.MetricType_GAUGE.Enum(),
+	}
+	lastError := &io_prometheus_client.MetricFamily{
+		Name: proto.String("ae_scrape_last_error"),
+		Help: proto.String("Always 1, with the category of the latest failed scrape of the target as the error label."),
+		Type: io_prometheus_client.MetricType_GAUGE.Enum(),
+	}
+
+	for _, result := range results {
+		value := 1.0
+		if result.Error != nil {
+			value = 0
+		}
+		up.Metric = append(up.Metric, scrapeMetric(result, value))
+
+		errorMetric := scrapeMetric(result, 1-value)
+		if result.ErrorCategory != "" {
+			errorMetric.Label = append(errorMetric.Label, &io_prometheus_client.LabelPair{Name: proto.String("category"), Value: proto.String(result.ErrorCategory)})
+		}
+		scrapeError.Metric = append(scrapeError.Metric, errorMetric)
+
+		if !result.LastSuccess.IsZero() {
+			lastScrape.Metric = append(lastScrape.Metric, &io_prometheus_client.Metric{
+				Label: scrapeMetricLabels(result),
+				Gauge: &io_prometheus_client.Gauge{Value: proto.Float64(float64(result.LastSuccess.UnixNano()) / 1e9)},
+			})
+		}
+		if result.StatusCode != 0 {
+			responseBytes.Metric = append(responseBytes.Metric, &io_prometheus_client.Metric{
+				Label: scrapeMetricLabels(result),
+				Gauge: &io_prometheus_client.Gauge{Value: proto.Float64(float64(result.ResponseBytes))},
+			})
+		}
+		if *scrapeMetricsLastError && result.LastErrorCategory != "" {
+			lastError.Metric = append(lastError.Metric, &io_prometheus_client.Metric{
+				Label: append(scrapeMetricLabels(result), &io_prometheus_client.LabelPair{Name: proto.String("error"), Value: proto.String(result.LastErrorCategory)}),
+				Gauge: &io_prometheus_client.Gauge{Value: proto.Float64(1)},
+			})
+		}
+	}
+
+	if len(results) > 0 {
+		addFamily(families, up)
+		addFamily(families, scrapeError)
+	}
+	if len(lastScrape.Metric) > 0 {
+		addFamily(families, lastScrape)
+	}
+	if len(responseBytes.Metric) > 0 {
+		addFamily(families, responseBytes)
+	}
+	if len(lastError.Metric) > 0 {
+		addFamily(families, lastError)
+	}
+}
+
+// addFamily adds a family generated by the exporter to families. If a target
+// already has a family of that name, such as the ae_up series of a nested
+// aggregate exporter, the series of mf are added to it, or mf is left out
+// with a warning if the types differ.
+func addFamily(families map[string]*io_prometheus_client.MetricFamily, mf *io_prometheus_client.MetricFamily) {
+	existing, ok := families[mf.GetName()]
+	if !ok {
+		families[mf.GetName()] = mf
+		return
+	}
+	if existing.GetType() != mf.GetType() {
+		log.Printf("WARNING: not adding %s, a target has %s metrics of that name", mf.GetName(), strings.ToLower(existing.GetType().String()))
+		return
+	}
+	existing.Metric = append(existing.Metric, mf.Metric...)
+}
+
+func scrapeMetric(result *Result, value float64) *io_prometheus_client.Metric {
+	m := &io_prometheus_client.Metric{
+		Label: scrapeMetricLabels(result),
+		Gauge: &io_prometheus_client.Gauge{Value: proto.Float64(value)},
+	}
+	if *scrapeMetricsCodeLabel && result.StatusCode != 0 {
+		m.Label = append(m.Label, &io_prometheus_client.LabelPair{Name: proto.String("code"), Value: proto.String(strconv.Itoa(result.StatusCode))})
+	}
+	return m
+}
+
+// addResponseSizeMetrics adds ae_response_too_small for the targets with a
+// min_bytes, 1 if their last response was smaller than that.
+func addResponseSizeMetrics(families map[string]*io_prometheus_client.MetricFamily, results []*Result) {
+	tooSmall := &io_prometheus_client.MetricFamily{
+		Name: proto.String("ae_response_too_small"),
+		Help: proto.String("1 if the target returned fewer bytes than its min_bytes, 0 otherwise."),
+		Type: io_prometheus_client.MetricType_GAUGE.Enum(),
+	}
+	for _, result := range results {
+		if result.Target == nil || result.Target.MinBytes <= 0 || result.Error != nil {
+			continue
+		}
+		value := 0.0
+		if result.TooSmall {
+			value = 1
+		}
+		tooSmall.Metric = append(tooSmall.Metric, &io_prometheus_client.Metric{
+			Label: scrapeMetricLabels(result),
+			Gauge: &io_prometheus_client.Gauge{Value: proto.Float64(value)},
+		})
+	}
+	if len(tooSmall.Metric) > 0 {
+		addFamily(families, tooSmall)
+	}
+}
+
+// scrapeMetricLabels returns the labels identifying the target of result.
+func scrapeMetricLabels(result *Result) []*io_prometheus_client.LabelPair {
+	labels := append(sourceLabels(result.URL), result.Target.labelPairs()...)
+	return append(labels, schemeLabels(result.URL)...)
+}
+
+// lastSuccesses remembers when each target was last scraped successfully.
+type lastSuccesses struct {
+	mu    sync.Mutex
+	times map[*Target]time.Time
+}
+
+// record sets result.LastSuccess, to now if result is a success.
+func (l *lastSuccesses) record(target *Target, result *Result) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if result.Error == nil {
+		if l.times == nil {
+			l.times = make(map[*Target]time.Time)
+		}
+		l.times[target] = time.Now()
+	}
+	result.LastSuccess = l.times[target]
+}
+
+// retarget moves the times of the targets in moved to those replacing them
+// after a reload and forgets targets that were removed.
+func (l *lastSuccesses) retarget(moved map[*Target]*Target) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	times := make(map[*Target]time.Time, len(l.times))
+	for target, t := range l.times {
+		if replacement, ok := moved[target]; ok {
+			times[replacement] = t
+		}
+	}
+	l.times = times
+}
+
+// lastErrors remembers the category of the latest failed scrape of each
+// target. Only the categories of classifyError are kept rather than the error
+// messages so the error label of ae_scrape_last_error has few values.
+type lastErrors struct {
+	mu         sync.Mutex
+	categories map[*Target]string
+}
+
+// record sets result.LastErrorCategory, to the category of result if it is a
+// failure.
+func (l *lastErrors) record(target *Target, result *Result) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if result.Error != nil {
+		if l.categories == nil {
+			l.categories = make(map[*Target]string)
+		}
+		category := result.ErrorCategory
+		if category == "" {
+			category = errorOther
+		}
+		l.categories[target] = category
+	}
+	result.LastErrorCategory = l.categories[target]
+}
+
+// retarget moves the categories of the targets in moved to those replacing
+// them after a reload and forgets targets that were removed.
+func (l *lastErrors) retarget(moved map[*Target]*Target) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	categories := make(map[*Target]string, len(l.categories))
+	for target, category := range l.categories {
+		if replacement, ok := moved[target]; ok {
+			categories[replacement] = category
+		}
+	}
+	l.categories = categories
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_model/go"
+)
+
+func TestAddScrapeMetrics(t *testing.T) {
+	defer func(code bool) { *scrapeMetricsCodeLabel = code }(*scrapeMetricsCodeLabel)
+	*scrapeMetricsCodeLabel = true
+
+	families := map[string]*io_prometheus_client.MetricFamily{}
+	addScrapeMetrics(families, []*Result{
+		{URL: "http://a/metrics", StatusCode: 200},
+		{URL: "http://b/metrics", StatusCode: 503, Error: errors.New("failed")},
+		{URL: "http://c/metrics", Error: errors.New("connection refused")},
+	})
+
+	expected := []struct {
+		labels int
+		code   string
+		up     float64
+	}{{2, "200", 1}, {2, "503", 0}, {1, "", 0}}
+
+	for i, e := range expected {
+		up := families["ae_up"].Metric[i]
+		scrapeError := families["ae_scrape_error"].Metric[i]
+		if len(up.Label) != e.labels || (e.code != "" && up.Label[1].GetValue() != e.code) {
+			t.Errorf("unexpected labels on ae_up for target %d: %v", i, up.Label)
+		}
+		if up.Gauge.GetValue() != e.up || scrapeError.Gauge.GetValue() != 1-e.up {
+			t.Errorf("unexpected values for target %d: ae_up=%v ae_scrape_error=%v", i, up.Gauge.GetValue(), scrapeError.Gauge.GetValue())
+		}
+	}
+}
+
+func TestLastScrapeTimestamp(t *testing.T) {
+	target := &Target{URL: "http://a/metrics"}
+	successes := &lastSuccesses{}
+
+	failed := &Result{URL: target.URL, Target: target, Error: errors.New("failed")}
+	successes.record(target, failed)
+	if !failed.LastSuccess.IsZero() {
+		t.Errorf("expected no last success before the first successful scrape, got %s", failed.LastSuccess)
+	}
+
+	before := time.Now()
+	succeeded := &Result{URL: target.URL, Target: target}
+	successes.record(target, succeeded)
+	failed = &Result{URL: target.URL, Target: target, Error: errors.New("failed")}
+	successes.record(target, failed)
+	if succeeded.LastSuccess.Before(before) || !failed.LastSuccess.Equal(succeeded.LastSuccess) {
+		t.Errorf("expected a failure to keep the time of the last success %s, got %s", succeeded.LastSuccess, failed.LastSuccess)
+	}
+
+	families := map[string]*io_prometheus_client.MetricFamily{}
+	addScrapeMetrics(families, []*Result{failed, {URL: "http://b/metrics", Error: errors.New("failed")}})
+	metrics := families["ae_last_scrape_timestamp_seconds"].GetMetric()
+	if len(metrics) != 1 || metrics[0].Gauge.GetValue() != float64(failed.LastSuccess.UnixNano())/1e9 {
+		t.Errorf("expected a timestamp only for the target that was scraped before, got %v", metrics)
+	}
+}
+
+func TestScrapeLastError(t *testing.T) {
+	defer func(enabled bool) { *scrapeMetricsLastError = enabled }(*scrapeMetricsLastError)
+	*scrapeMetricsLastError = true
+
+	target := &Target{URL: "http://a/metrics"}
+	tracker := &lastErrors{}
+
+	succeeded := &Result{URL: target.URL, Target: target}
+	tracker.record(target, succeeded)
+	timedOut := &Result{URL: target.URL, Target: target, Error: errors.New("i/o timeout"), ErrorCategory: errorTimeout}
+	tracker.record(target, timedOut)
+	recovered := &Result{URL: target.URL, Target: target}
+	tracker.record(target, recovered)
+	if succeeded.LastErrorCategory != "" || recovered.LastErrorCategory != errorTimeout {
+		t.Errorf("expected the last error to be kept after recovering, got %q and %q", succeeded.LastErrorCategory, recovered.LastErrorCategory)
+	}
+
+	families := map[string]*io_prometheus_client.MetricFamily{}
+	addScrapeMetrics(families, []*Result{recovered, {URL: "http://b/metrics"}})
+	metrics := families["ae_scrape_last_error"].GetMetric()
+	if len(metrics) != 1 || labelString(metrics[0]) != "ae_source=http://a/metrics,error=timeout," || metrics[0].Gauge.GetValue() != 1 {
+		t.Errorf("expected a last error only for the target that failed before, got %v", metrics)
+	}
+}
+
+func TestResponseTooSmall(t *testing.T) {
+	server := newFixtureServer("histogram.txt")
+	defer server.Close()
+
+	output := &bytes.Buffer{}
+	targets := []*Target{{URL: server.URL, MinBytes: 1 << 20}, {URL: server.URL + "/small", MinBytes: 10}, {URL: server.URL + "/unchecked"}}
+	(&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate(targets, output, AggregateOptions{})
+
+	families, err := getMetricFamilies(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, m := range families["ae_response_too_small"].GetMetric() {
+		values[findLabel(m, *targetLabelName).GetValue()] = m.GetGauge().GetValue()
+	}
+	if len(values) != 2 || values[targets[0].URL] != 1 || values[targets[1].URL] != 0 {
+		t.Errorf("expected only the first target to be too small and the last to be unchecked, got %v", values)
+	}
+}
+
+func TestScrapeResponseBytes(t *testing.T) {
+	defer func(enabled bool) { *scrapeMetricsEnabled = enabled }(*scrapeMetricsEnabled)
+	*scrapeMetricsEnabled = true
+
+	server := newFixtureServer("histogram.txt")
+	defer server.Close()
+
+	output := &bytes.Buffer{}
+	targets := []*Target{{URL: server.URL}, {URL: "http://127.0.0.1:1/metrics"}}
+	(&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate(targets, output, AggregateOptions{})
+
+	families, err := getMetricFamilies(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := families["ae_scrape_response_bytes"].GetMetric()
+	expected := len(mustReadAll(mustOpenFile("histogram.txt", os.O_RDONLY)))
+	if len(metrics) != 1 || findLabel(metrics[0], *targetLabelName).GetValue() != server.URL || metrics[0].GetGauge().GetValue() != float64(expected) {
+		t.Errorf("expected the response size of %d bytes only for the target that answered, got %v", expected, metrics)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_model/go"
+)
+
+// selfRegistry holds metrics describing the exporter itself rather than its
+// targets. They are served separately on /self-metrics.
+var selfRegistry = prometheus.NewRegistry()
+
+var aggregationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "ae_aggregation_duration_seconds",
+	Help:    "Time taken by an aggregation from dispatching the scrapes until the output has been encoded.",
+	Buckets: prometheus.DefBuckets,
+})
+
+var lastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "ae_config_last_reload_success",
+	Help: "Whether the last config reload succeeded.",
+})
+
+var lastReloadTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "ae_config_last_reload_timestamp_seconds",
+	Help: "Time of the last config reload attempt.",
+})
+
+var fetchesInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "ae_fetches_in_flight",
+	Help: "Number of target fetches running right now.",
+})
+
+var fetchesInFlightHighWater = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "ae_fetches_in_flight_max",
+	Help: "Highest number of target fetches that ran at once since the exporter started.",
+})
+
+var concurrencyWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "ae_fetch_concurrency_wait_seconds",
+	Help:    "Time fetches waited for a free -targets.max.concurrency slot.",
+	Buckets: prometheus.DefBuckets,
+})
+
+var nonFiniteDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "ae_non_finite_samples_dropped_total",
+	Help: "Samples with a NaN or infinite value dropped because of -targets.non-finite=drop.",
+})
+
+var pushFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "ae_push_failures_total",
+	Help: "Pushes to -push.url that failed.",
+})
+
+var outputFileFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "ae_output_file_failures_total",
+	Help: "Writes of the aggregated metrics to -output.file that failed.",
+})
+
+var labelCollisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ae_label_collisions_total",
+	Help: "Metrics that already had a label added by the exporter, by the -targets.label.conflict strategy that resolved it.",
+}, []string{"strategy"})
+
+var requestsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "ae_requests_rejected_total",
+	Help: "Metrics requests rejected with 503 because -web.max.concurrent.requests were already being handled.",
+})
+
+func init() {
+	selfRegistry.MustRegister(aggregationDuration, lastReloadSuccess, lastReloadTimestamp, fetchesInFlight, fetchesInFlightHighWater, concurrencyWait, nonFiniteDropped, pushFailures, outputFileFailures, labelCollisions, requestsRejected)
+
+	// Loading the config on startup counts as the first reload.
+	lastReloadSuccess.Set(1)
+	lastReloadTimestamp.SetToCurrentTime()
+}
+
+// addSelfMetrics adds the metrics of selfRegistry to families for
+// -web.include-self-metrics. Their ae_ prefix becomes ae_self_ so they are
+// told apart from the ae_ metrics added for targets and from those of nested
+// aggregators. A family that still has the name of a target's is left out.
+func addSelfMetrics(families map[string]*io_prometheus_client.MetricFamily) {
+	gathered, err := selfRegistry.Gather()
+	if err != nil {
+		log.Printf("Failed to gather self metrics: %s", err.Error())
+	}
+	for _, mf := range gathered {
+		name := "ae_self_" + strings.TrimPrefix(mf.GetName(), "ae_")
+		if _, ok := families[name]; ok {
+			log.Printf("WARNING: not adding self metric %s, a target has metrics of that name", name)
+			continue
+		}
+		mf.Name = proto.String(name)
+		families[name] = mf
+	}
+}
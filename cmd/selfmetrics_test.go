@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_model/go"
+)
+
+func gatherSelfMetric(t *testing.T, name string) *io_prometheus_client.MetricFamily {
+	families, err := selfRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == name {
+			return mf
+		}
+	}
+	return nil
+}
+
+func TestAggregationDuration(t *testing.T) {
+	server := newFixtureServer("histogram.txt")
+	defer server.Close()
+
+	before := gatherSelfMetric(t, "ae_aggregation_duration_seconds").Metric[0].Histogram.GetSampleCount()
+	(&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate([]*Target{{URL: server.URL}}, &bytes.Buffer{}, AggregateOptions{})
+	after := gatherSelfMetric(t, "ae_aggregation_duration_seconds").Metric[0].Histogram.GetSampleCount()
+
+	if after != before+1 {
+		t.Errorf("expected the aggregation to be observed once, count went from %d to %d", before, after)
+	}
+}
+
+func TestMetricsHandlerIncludeSelfMetrics(t *testing.T) {
+	defer func(enabled bool) { *webIncludeSelfMetrics = enabled }(*webIncludeSelfMetrics)
+	*webIncludeSelfMetrics = true
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "# TYPE ae_self_fetches_in_flight gauge\nae_self_fetches_in_flight 42\n")
+	}))
+	defer server.Close()
+
+	config := &Config{Targets: []*Target{{URL: server.URL}}}
+	rec := httptest.NewRecorder()
+	metricsHandler(config, &Aggregator{HTTP: &http.Client{Timeout: time.Second}})(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	families, err := getMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if families["ae_self_aggregation_duration_seconds"] == nil || families["ae_aggregation_duration_seconds"] != nil {
+		t.Errorf("expected the self metrics with the ae_self_ prefix, got %v", families)
+	}
+	if inFlight := families["ae_self_fetches_in_flight"].GetMetric(); len(inFlight) != 1 || inFlight[0].Gauge.GetValue() != 42 {
+		t.Errorf("expected the target's metric to be kept over a self metric of the same name, got %v", inFlight)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// selfTest pushes a synthetic metric family through the same encoder used by
+// Aggregate in format and parses the output again, so an incompatible
+// exposition library is caught on startup rather than by the first Prometheus
+// scrape. The exposition library cannot parse OpenMetrics, so that output is
+// checked for its "# EOF" line and parsed as text, which works because the
+// lines of a gauge are the same in both formats.
+func selfTest(format expfmt.Format) error {
+	name := "ae_self_test"
+	expected := &io_prometheus_client.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String("Synthetic metric used to test encoding."),
+		Type: io_prometheus_client.MetricType_GAUGE.Enum(),
+		Metric: []*io_prometheus_client.Metric{
+			{
+				Label: []*io_prometheus_client.LabelPair{{Name: targetLabelName, Value: proto.String("http://localhost:8081/metrics")}},
+				Gauge: &io_prometheus_client.Gauge{Value: proto.Float64(42)},
+			},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := encodeMetricFamilies(buf, map[string]*io_prometheus_client.MetricFamily{name: expected}, format); err != nil {
+		return fmt.Errorf("failed to encode: %s", err.Error())
+	}
+	encoded := buf.String()
+
+	if format == expfmt.FmtOpenMetrics && !strings.HasSuffix(encoded, "# EOF\n") {
+		return fmt.Errorf("encoded OpenMetrics output does not end with # EOF: %s", encoded)
+	}
+	families, err := decodeSelfTest(buf, format)
+	if err != nil {
+		return fmt.Errorf("failed to parse encoded output: %s", err.Error())
+	}
+	if actual, ok := families[name]; !ok || !proto.Equal(expected, actual) {
+		return fmt.Errorf("parsed metric family does not match the one encoded: %s", encoded)
+	}
+	return nil
+}
+
+// decodeSelfTest parses the output of selfTest in format.
+func decodeSelfTest(r io.Reader, format expfmt.Format) (map[string]*io_prometheus_client.MetricFamily, error) {
+	if format != expfmt.FmtProtoDelim {
+		return getMetricFamilies(r)
+	}
+	families := map[string]*io_prometheus_client.MetricFamily{}
+	decoder := expfmt.NewDecoder(r, format)
+	for {
+		mf := &io_prometheus_client.MetricFamily{}
+		if err := decoder.Decode(mf); err == io.EOF {
+			return families, nil
+		} else if err != nil {
+			return nil, err
+		}
+		families[mf.GetName()] = mf
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the certificate of -web.tls.cert-file and
+// -web.tls.key-file and loads it again when either file changes or on SIGHUP,
+// so rotated certificates are picked up without a restart. The previous
+// certificate is kept when the new files cannot be loaded, e.g. while only one
+// of them has been replaced.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	certTime, keyTime := modTime(c.certFile), modTime(c.keyFile)
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert, c.certTime, c.keyTime = &cert, certTime, keyTime
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	changed := !modTime(c.certFile).Equal(c.certTime) || !modTime(c.keyFile).Equal(c.keyTime)
+	c.mu.Unlock()
+	if changed {
+		if err := c.reload(); err != nil {
+			log.Printf("Reloading TLS certificate failed, keeping the previous one: %s", err.Error())
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+func (c *certReloader) reloadOnSignal(signals <-chan os.Signal) {
+	for range signals {
+		if err := c.reload(); err != nil {
+			log.Printf("Reloading TLS certificate failed, keeping the previous one: %s", err.Error())
+		}
+	}
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
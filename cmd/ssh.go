@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshTunnel is the SSH server a target is scraped through, e.g. the jump host
+// of a network the exporter cannot reach directly.
+type sshTunnel struct {
+	// Host is the host:port of the SSH server.
+	Host string `json:"host"`
+	User string `json:"user"`
+
+	// KeyFile is the unencrypted private key used to authenticate.
+	KeyFile string `json:"key_file"`
+
+	// KnownHostsFile holds the accepted host keys of the server. Defaults to
+	// ~/.ssh/known_hosts.
+	KnownHostsFile string `json:"known_hosts_file"`
+}
+
+func (t *sshTunnel) validate() error {
+	if t.Host == "" || t.User == "" || t.KeyFile == "" {
+		return fmt.Errorf("ssh needs a host, user and key_file")
+	}
+	if _, _, err := net.SplitHostPort(t.Host); err != nil {
+		return fmt.Errorf("ssh host %q must be host:port", t.Host)
+	}
+	return nil
+}
+
+// clientConfig reads the key and known hosts of the tunnel. They are read on
+// every connect so rotated keys are picked up without a restart.
+func (t sshTunnel) clientConfig() (*ssh.ClientConfig, error) {
+	key, err := ioutil.ReadFile(t.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", t.KeyFile, err.Error())
+	}
+
+	knownHostsFile := t.KnownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:            t.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         time.Duration(*targetDialTimeout) * time.Millisecond,
+	}, nil
+}
+
+// sshDialer opens connections through an SSH tunnel. The SSH connection is
+// shared by all scrapes through the tunnel and opened again when it breaks.
+// mu only guards client, so a tunnel that is slow to connect does not hold up
+// scrapes over an open connection, and each connect is bounded by ctx.
+type sshDialer struct {
+	tunnel sshTunnel
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+func (d *sshDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if client := d.current(); client != nil {
+		conn, err := client.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		// The server may have closed the connection while it was idle so try
+		// once more over a new one.
+		d.drop(client)
+	}
+
+	client, err := d.connect(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ssh tunnel %s: %s", d.tunnel.Host, err.Error())
+	}
+	conn, err := client.DialContext(ctx, network, addr)
+	if err != nil {
+		d.drop(client)
+		return nil, fmt.Errorf("ssh tunnel %s: %s", d.tunnel.Host, err.Error())
+	}
+	return conn, nil
+}
+
+func (d *sshDialer) current() *ssh.Client {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.client
+}
+
+// drop closes client and forgets it unless another scrape has already
+// replaced it.
+func (d *sshDialer) drop(client *ssh.Client) {
+	d.mu.Lock()
+	if d.client == client {
+		d.client = nil
+	}
+	d.mu.Unlock()
+	client.Close()
+}
+
+// connect opens a new SSH connection and makes it the shared one, or returns
+// the connection another scrape opened in the meantime. Connecting and the
+// handshake give up when ctx is done or after -targets.dial.timeout, or
+// -targets.scrape.timeout if that is not set.
+func (d *sshDialer) connect(ctx context.Context) (*ssh.Client, error) {
+	config, err := d.tunnel.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = time.Duration(*targetScrapeTimeout) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", d.tunnel.Host)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake does not take a context, so it is aborted by moving the
+	// deadline of the connection into the past when ctx is done.
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, d.tunnel.Host, config)
+	close(stop)
+	<-stopped
+	if err == nil {
+		// ctx may have been done just as the handshake finished.
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(sshConn, channels, requests)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client != nil {
+		client.Close()
+		return d.client, nil
+	}
+	d.client = client
+	return client, nil
+}
+
+// sshClients holds a client per SSH tunnel so targets behind the same jump
+// host share its connection.
+type sshClients struct {
+	mu      sync.Mutex
+	clients map[sshTunnel]*http.Client
+}
+
+// client returns the client that scrapes through tunnel with the settings of base.
+func (s *sshClients) client(base *http.Client, tunnel sshTunnel) *http.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if client, ok := s.clients[tunnel]; ok {
+		return client
+	}
+
+	baseTransport, ok := base.Transport.(*http.Transport)
+	if !ok {
+		baseTransport = http.DefaultTransport.(*http.Transport)
+	}
+	transport := baseTransport.Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&sshDialer{tunnel: tunnel}).DialContext
+
+	client := *base
+	client.Transport = transport
+	if s.clients == nil {
+		s.clients = make(map[sshTunnel]*http.Client)
+	}
+	s.clients[tunnel] = &client
+	return &client
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func mustNewSigner() (ssh.Signer, ed25519.PrivateKey) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return signer, key
+}
+
+// newSSHServer starts an SSH server accepting clientKey that forwards
+// direct-tcpip channels and counts them in forwarded.
+func newSSHServer(t *testing.T, clientKey ssh.PublicKey, forwarded *int32) (net.Listener, ssh.PublicKey) {
+	hostSigner, _ := mustNewSigner()
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, io.EOF
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config, forwarded)
+		}
+	}()
+	return listener, hostSigner.PublicKey()
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig, forwarded *int32) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		var destination struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if newChannel.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChannel.ExtraData(), &destination) != nil {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		remote, err := net.Dial("tcp", net.JoinHostPort(destination.Host, strconv.Itoa(int(destination.Port))))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			remote.Close()
+			continue
+		}
+		atomic.AddInt32(forwarded, 1)
+		go ssh.DiscardRequests(channelRequests)
+		go func() {
+			io.Copy(channel, remote)
+			channel.Close()
+		}()
+		go func() {
+			io.Copy(remote, channel)
+			remote.Close()
+		}()
+	}
+}
+
+func TestFetchSSHTunnel(t *testing.T) {
+	server := newFixtureServer("histogram.txt")
+	defer server.Close()
+
+	signer, key := mustNewSigner()
+	var forwarded int32
+	listener, hostKey := newSSHServer(t, signer.PublicKey(), &forwarded)
+	defer listener.Close()
+
+	dir, err := ioutil.TempDir("", "aggregate-exporter-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, knownHostsFile := filepath.Join(dir, "id_ed25519"), filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, hostKey)
+	if err := ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel := &sshTunnel{Host: listener.Addr().String(), User: "scraper", KeyFile: keyFile, KnownHostsFile: knownHostsFile}
+	aggregator := &Aggregator{HTTP: &http.Client{Transport: mustNewTransport(), Timeout: time.Second}}
+	for i := 0; i < 2; i++ {
+		resultChan := make(chan *Result, 1)
+		aggregator.fetch(context.Background(), &Target{URL: server.URL, SSH: tunnel}, resultChan)
+		if result := <-resultChan; result.Error != nil || len(result.MetricFamily) == 0 {
+			t.Fatalf("expected the target to be scraped through the tunnel, got %d families and error %v", len(result.MetricFamily), result.Error)
+		}
+	}
+	if n := atomic.LoadInt32(&forwarded); n != 1 {
+		t.Errorf("expected both scrapes over one forwarded connection, got %d", n)
+	}
+
+	// A host key that is not in the known hosts file must be rejected.
+	otherHost, _ := mustNewSigner()
+	line = knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, otherHost.PublicKey())
+	if err := ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	resultChan := make(chan *Result, 1)
+	(&Aggregator{HTTP: &http.Client{Transport: mustNewTransport(), Timeout: time.Second}}).fetch(context.Background(), &Target{URL: server.URL, SSH: tunnel}, resultChan)
+	if result := <-resultChan; result.Error == nil {
+		t.Error("expected an unknown host key to fail the scrape")
+	}
+}
+
+func TestSSHDialerGivesUpOnHungTunnel(t *testing.T) {
+	defer func(dial, scrape int) {
+		*targetDialTimeout = dial
+		*targetScrapeTimeout = scrape
+	}(*targetDialTimeout, *targetScrapeTimeout)
+	*targetDialTimeout = 0
+	*targetScrapeTimeout = 100
+
+	// The tunnel accepts connections and never starts the handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	_, key := mustNewSigner()
+	dir, err := ioutil.TempDir("", "aggregate-exporter-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, knownHostsFile := filepath.Join(dir, "id_ed25519"), filepath.Join(dir, "known_hosts")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(knownHostsFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dialer := &sshDialer{tunnel: sshTunnel{Host: listener.Addr().String(), User: "scraper", KeyFile: keyFile, KnownHostsFile: knownHostsFile}}
+	start := time.Now()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := dialer.DialContext(context.Background(), "tcp", "127.0.0.1:1")
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err == nil {
+			t.Error("expected the dial through a hung tunnel to fail")
+		}
+	}
+	// Both dials time out at the same time rather than one after the other.
+	if elapsed := time.Since(start); elapsed > 180*time.Millisecond {
+		t.Errorf("expected both dials to give up after the scrape timeout, took %s", elapsed)
+	}
+}
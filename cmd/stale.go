@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_model/go"
+)
+
+// lastGoodResults remembers the latest successful scrape of each target for
+// -targets.stale.max.
+type lastGoodResults struct {
+	mu      sync.Mutex
+	results map[*Target]*lastGoodResult
+}
+
+type lastGoodResult struct {
+	at       time.Time
+	families map[string]*io_prometheus_client.MetricFamily
+}
+
+// store remembers a copy of the families of a successful result.
+func (l *lastGoodResults) store(target *Target, result *Result) {
+	families := cloneMetricFamilies(result.MetricFamily)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.results == nil {
+		l.results = make(map[*Target]*lastGoodResult)
+	}
+	l.results[target] = &lastGoodResult{at: time.Now(), families: families}
+}
+
+// retarget moves the results of the targets in moved to those replacing them
+// after a reload and forgets targets that were removed.
+func (l *lastGoodResults) retarget(moved map[*Target]*Target) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	results := make(map[*Target]*lastGoodResult, len(l.results))
+	for target, result := range l.results {
+		if replacement, ok := moved[target]; ok {
+			results[replacement] = result
+		}
+	}
+	l.results = results
+}
+
+// fill gives a failed result the families of the last successful scrape of
+// target if it is no older than -targets.stale.max. The error is kept so the
+// target is still reported as down.
+func (l *lastGoodResults) fill(target *Target, result *Result) {
+	l.mu.Lock()
+	lastGood, ok := l.results[target]
+	l.mu.Unlock()
+	if !ok || time.Since(lastGood.at) > *targetStaleMax {
+		return
+	}
+	result.MetricFamily = cloneMetricFamilies(lastGood.families)
+	result.Stale = true
+}
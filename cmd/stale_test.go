@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAggregateServesStaleResults(t *testing.T) {
+	defer func(max time.Duration, scrapeMetrics bool) {
+		*targetStaleMax, *scrapeMetricsEnabled = max, scrapeMetrics
+	}(*targetStaleMax, *scrapeMetricsEnabled)
+	*targetStaleMax, *scrapeMetricsEnabled = time.Minute, true
+
+	fixture := mustReadAll(mustOpenFile("histogram.txt", 0))
+	var failing int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(rw, "<html>down</html>", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(rw, fixture)
+	}))
+	defer server.Close()
+
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second}}
+	targets := []*Target{{URL: server.URL}}
+	aggregator.Aggregate(targets, &bytes.Buffer{}, AggregateOptions{})
+
+	atomic.StoreInt32(&failing, 1)
+	output := &bytes.Buffer{}
+	aggregator.Aggregate(targets, output, AggregateOptions{})
+
+	if !strings.Contains(output.String(), `http_requests_total{method="post",code="200",ae_source="`+server.URL+`"} 1027`) {
+		t.Errorf("expected the last good metrics of the failing target, got:\n%s", output.String())
+	}
+	if !strings.Contains(output.String(), `ae_up{ae_source="`+server.URL+`"} 0`) {
+		t.Errorf("expected the failing target to be reported as down, got:\n%s", output.String())
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_model/go"
+)
+
+// Modes for -output.aggregate.mode.
+const (
+	// aggregateModeNone keeps the series of every target apart.
+	aggregateModeNone = "none"
+	// aggregateModeSum adds up counters and histograms that only differ by
+	// their source, see sumFamilies.
+	aggregateModeSum = "sum"
+	// aggregateModeMax, aggregateModeMin and aggregateModeAvg keep the
+	// highest, lowest or average value of gauges, counters and untyped
+	// metrics that only differ by their source, see combineFamilies.
+	aggregateModeMax = "max"
+	aggregateModeMin = "min"
+	aggregateModeAvg = "avg"
+)
+
+func validAggregateMode(mode string) bool {
+	switch mode {
+	case aggregateModeNone, aggregateModeSum, aggregateModeMax, aggregateModeMin, aggregateModeAvg:
+		return true
+	}
+	return false
+}
+
+// aggregateSourceLabel returns the label identifying the target of a series
+// that is ignored when series of different targets are combined.
+func aggregateSourceLabel() string {
+	if *targetLabelJob != "" {
+		return "instance"
+	}
+	return *targetLabelName
+}
+
+// sumFamilies replaces the counters and histograms of families with one
+// series per label set, ignoring the label identifying their target, that is
+// the sum of the series of all targets. Histograms are only added up when
+// their bucket boundaries match the most common ones of the series, see
+// referenceHistograms. Other types are left as they are.
+func sumFamilies(families map[string]*io_prometheus_client.MetricFamily) {
+	source := aggregateSourceLabel()
+	for _, mf := range families {
+		switch mf.GetType() {
+		case io_prometheus_client.MetricType_COUNTER, io_prometheus_client.MetricType_HISTOGRAM:
+			mf.Metric = sumMetrics(mf, source)
+		}
+	}
+}
+
+func sumMetrics(mf *io_prometheus_client.MetricFamily, source string) []*io_prometheus_client.Metric {
+	summed := []*io_prometheus_client.Metric{}
+	byKey := make(map[string]*io_prometheus_client.Metric)
+	var references map[string]*io_prometheus_client.Histogram
+	if mf.GetType() == io_prometheus_client.MetricType_HISTOGRAM {
+		references = referenceHistograms(mf, source)
+	}
+	for _, m := range mf.Metric {
+		labels := withoutLabel(m.Label, source)
+		key := labelSetKey(labels)
+		total, ok := byKey[key]
+		if !ok {
+			total = &io_prometheus_client.Metric{Label: labels}
+			if mf.GetType() == io_prometheus_client.MetricType_COUNTER {
+				total.Counter = &io_prometheus_client.Counter{Value: proto.Float64(0)}
+			} else {
+				total.Histogram = emptyHistogram(references[key])
+			}
+			byKey[key] = total
+			summed = append(summed, total)
+		}
+
+		if mf.GetType() == io_prometheus_client.MetricType_COUNTER {
+			total.Counter.Value = proto.Float64(total.Counter.GetValue() + m.Counter.GetValue())
+			continue
+		}
+		if !addHistogram(total.Histogram, m.Histogram) {
+			log.Printf("Skipped %s from %s in the sum: its buckets do not match those of most targets", mf.GetName(), findLabel(m, source).GetValue())
+		}
+	}
+	return summed
+}
+
+// referenceHistograms returns, for every label set of the histograms of mf
+// ignoring source, the histogram whose buckets the series are summed into:
+// the first, in the order the targets were given, of those with the most
+// common bucket boundaries. A single target with different buckets is then
+// what gets skipped, rather than the targets that agree.
+func referenceHistograms(mf *io_prometheus_client.MetricFamily, source string) map[string]*io_prometheus_client.Histogram {
+	type layout struct {
+		first *io_prometheus_client.Histogram
+		count int
+	}
+	layouts := make(map[string][]*layout)
+	for _, m := range mf.Metric {
+		key := labelSetKey(withoutLabel(m.Label, source))
+		bounds := bucketBoundsKey(m.Histogram)
+		var found *layout
+		for _, l := range layouts[key] {
+			if bucketBoundsKey(l.first) == bounds {
+				found = l
+				break
+			}
+		}
+		if found == nil {
+			found = &layout{first: m.Histogram}
+			layouts[key] = append(layouts[key], found)
+		}
+		found.count++
+	}
+
+	references := make(map[string]*io_prometheus_client.Histogram, len(layouts))
+	for key, candidates := range layouts {
+		best := candidates[0]
+		for _, l := range candidates[1:] {
+			if l.count > best.count {
+				best = l
+			}
+		}
+		references[key] = best.first
+	}
+	return references
+}
+
+// bucketBoundsKey identifies the bucket boundaries of h.
+func bucketBoundsKey(h *io_prometheus_client.Histogram) string {
+	bounds := make([]string, 0, len(h.GetBucket()))
+	for _, b := range h.GetBucket() {
+		bounds = append(bounds, strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64))
+	}
+	return strings.Join(bounds, ",")
+}
+
+// withoutLabel returns labels without the one called name.
+func withoutLabel(labels []*io_prometheus_client.LabelPair, name string) []*io_prometheus_client.LabelPair {
+	kept := make([]*io_prometheus_client.LabelPair, 0, len(labels))
+	for _, l := range labels {
+		if l.GetName() != name {
+			kept = append(kept, l)
+		}
+	}
+	return kept
+}
+
+// combineFamilies replaces the gauges, counters and untyped metrics of
+// families with one series per label set, ignoring the label identifying
+// their target, whose value is the max, min or avg given by mode of the
+// targets that have the series. A series missing from some targets is
+// combined from the others only, so the average is not dragged down by
+// them. Histograms and summaries are left as they are.
+func combineFamilies(families map[string]*io_prometheus_client.MetricFamily, mode string) {
+	source := aggregateSourceLabel()
+	for _, mf := range families {
+		switch mf.GetType() {
+		case io_prometheus_client.MetricType_GAUGE, io_prometheus_client.MetricType_COUNTER, io_prometheus_client.MetricType_UNTYPED:
+			mf.Metric = combineMetrics(mf, source, mode)
+		}
+	}
+}
+
+func combineMetrics(mf *io_prometheus_client.MetricFamily, source, mode string) []*io_prometheus_client.Metric {
+	combined := []*io_prometheus_client.Metric{}
+	values := make(map[string]float64)
+	counts := make(map[string]int)
+	byKey := make(map[string]*io_prometheus_client.Metric)
+	for _, m := range mf.Metric {
+		labels := make([]*io_prometheus_client.LabelPair, 0, len(m.Label))
+		for _, l := range m.Label {
+			if l.GetName() != source {
+				labels = append(labels, l)
+			}
+		}
+
+		key := labelSetKey(labels)
+		value := scalarValue(mf.GetType(), m)
+		if _, ok := byKey[key]; !ok {
+			byKey[key] = &io_prometheus_client.Metric{Label: labels}
+			combined = append(combined, byKey[key])
+			values[key], counts[key] = value, 1
+			continue
+		}
+		counts[key]++
+		switch mode {
+		case aggregateModeMax:
+			values[key] = math.Max(values[key], value)
+		case aggregateModeMin:
+			values[key] = math.Min(values[key], value)
+		case aggregateModeAvg:
+			values[key] += value
+		}
+	}
+
+	for key, m := range byKey {
+		value := values[key]
+		if mode == aggregateModeAvg {
+			value /= float64(counts[key])
+		}
+		setScalarValue(mf.GetType(), m, value)
+	}
+	return combined
+}
+
+// scalarValue returns the value of m, a gauge, counter or untyped metric.
+func scalarValue(t io_prometheus_client.MetricType, m *io_prometheus_client.Metric) float64 {
+	switch t {
+	case io_prometheus_client.MetricType_GAUGE:
+		return m.GetGauge().GetValue()
+	case io_prometheus_client.MetricType_COUNTER:
+		return m.GetCounter().GetValue()
+	}
+	return m.GetUntyped().GetValue()
+}
+
+func setScalarValue(t io_prometheus_client.MetricType, m *io_prometheus_client.Metric, value float64) {
+	switch t {
+	case io_prometheus_client.MetricType_GAUGE:
+		m.Gauge = &io_prometheus_client.Gauge{Value: proto.Float64(value)}
+	case io_prometheus_client.MetricType_COUNTER:
+		m.Counter = &io_prometheus_client.Counter{Value: proto.Float64(value)}
+	default:
+		m.Untyped = &io_prometheus_client.Untyped{Value: proto.Float64(value)}
+	}
+}
+
+// labelSetKey identifies a set of labels regardless of their order.
+func labelSetKey(labels []*io_prometheus_client.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.GetName()+"\xff"+l.GetValue())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xfe")
+}
+
+// emptyHistogram returns a histogram with the buckets of h and no samples.
+func emptyHistogram(h *io_prometheus_client.Histogram) *io_prometheus_client.Histogram {
+	empty := &io_prometheus_client.Histogram{SampleCount: proto.Uint64(0), SampleSum: proto.Float64(0)}
+	for _, b := range h.GetBucket() {
+		empty.Bucket = append(empty.Bucket, &io_prometheus_client.Bucket{UpperBound: b.UpperBound, CumulativeCount: proto.Uint64(0)})
+	}
+	return empty
+}
+
+// addHistogram adds h to total unless their buckets differ.
+func addHistogram(total, h *io_prometheus_client.Histogram) bool {
+	if len(total.Bucket) != len(h.GetBucket()) {
+		return false
+	}
+	for i, b := range h.GetBucket() {
+		if total.Bucket[i].GetUpperBound() != b.GetUpperBound() {
+			return false
+		}
+	}
+	for i, b := range h.GetBucket() {
+		total.Bucket[i].CumulativeCount = proto.Uint64(total.Bucket[i].GetCumulativeCount() + b.GetCumulativeCount())
+	}
+	total.SampleCount = proto.Uint64(total.GetSampleCount() + h.GetSampleCount())
+	total.SampleSum = proto.Float64(total.GetSampleSum() + h.GetSampleSum())
+	return true
+}
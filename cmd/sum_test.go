@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_model/go"
+)
+
+func TestAggregateSumMode(t *testing.T) {
+	defer func(mode string) { *outputAggregateMode = mode }(*outputAggregateMode)
+	*outputAggregateMode = aggregateModeSum
+
+	first, second := newFixtureServer("histogram-summary.txt"), newFixtureServer("histogram-summary-2.txt")
+	defer first.Close()
+	defer second.Close()
+	mismatched := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "# TYPE http_request_duration_seconds histogram\n"+
+			"http_request_duration_seconds_bucket{le=\"1\"} 7\n"+
+			"http_request_duration_seconds_bucket{le=\"+Inf\"} 7\n"+
+			"http_request_duration_seconds_sum 3\n"+
+			"http_request_duration_seconds_count 7\n"+
+			"# TYPE jobs_total counter\njobs_total{queue=\"a\"} 2\n")
+	}))
+	defer mismatched.Close()
+	counters := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "# TYPE jobs_total counter\njobs_total{queue=\"a\"} 3\njobs_total{queue=\"b\"} 1\n")
+	}))
+	defer counters.Close()
+
+	output := &bytes.Buffer{}
+	targets := []*Target{{URL: mismatched.URL}, {URL: first.URL}, {URL: second.URL}, {URL: counters.URL}}
+	(&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate(targets, output, AggregateOptions{})
+
+	families, err := getMetricFamilies(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	histograms := families["http_request_duration_seconds"].GetMetric()
+	if len(histograms) != 1 || len(histograms[0].Label) != 0 {
+		t.Fatalf("expected one histogram without a source label, got %v", histograms)
+	}
+	expected := &io_prometheus_client.Histogram{
+		SampleCount: proto.Uint64(144324),
+		SampleSum:   proto.Float64(53428),
+		Bucket: []*io_prometheus_client.Bucket{
+			{UpperBound: proto.Float64(0.05), CumulativeCount: proto.Uint64(24055)},
+			{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(33446)},
+			{UpperBound: proto.Float64(0.2), CumulativeCount: proto.Uint64(100395)},
+			{UpperBound: proto.Float64(math.Inf(1)), CumulativeCount: proto.Uint64(144324)},
+		},
+	}
+	if !proto.Equal(expected, histograms[0].Histogram) {
+		t.Errorf("expected the histograms with the most common buckets to be summed, got %v", histograms[0].Histogram)
+	}
+
+	if n := len(families["rpc_duration_seconds"].GetMetric()); n != 2 {
+		t.Errorf("expected summaries to be kept per target, got %d series", n)
+	}
+
+	sums := map[string]float64{}
+	for _, m := range families["jobs_total"].GetMetric() {
+		sums[labelString(m)] = m.Counter.GetValue()
+	}
+	if len(sums) != 2 || sums["queue=a,"] != 5 || sums["queue=b,"] != 1 {
+		t.Errorf("expected counters summed per queue, got %v", sums)
+	}
+}
+
+func TestAggregateCombineModes(t *testing.T) {
+	defer func(mode string) { *outputAggregateMode = mode }(*outputAggregateMode)
+
+	bodies := []string{
+		"# TYPE queue_depth gauge\nqueue_depth{queue=\"a\"} 4\nqueue_depth{queue=\"b\"} 10\n# TYPE latency summary\nlatency_sum 1\nlatency_count 1\n",
+		"# TYPE queue_depth gauge\nqueue_depth{queue=\"a\"} 2\n# TYPE latency summary\nlatency_sum 2\nlatency_count 1\n",
+		"# TYPE queue_depth gauge\nqueue_depth{queue=\"a\"} 9\n",
+	}
+	targets := []*Target{}
+	for _, body := range bodies {
+		body := body
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			io.WriteString(rw, body)
+		}))
+		defer server.Close()
+		targets = append(targets, &Target{URL: server.URL})
+	}
+
+	for mode, expected := range map[string]map[string]float64{
+		aggregateModeMax: {"queue=a,": 9, "queue=b,": 10},
+		aggregateModeMin: {"queue=a,": 2, "queue=b,": 10},
+		aggregateModeAvg: {"queue=a,": 5, "queue=b,": 10},
+	} {
+		*outputAggregateMode = mode
+		output := &bytes.Buffer{}
+		(&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate(targets, output, AggregateOptions{})
+		families, err := getMetricFamilies(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gauges := families["queue_depth"].GetMetric()
+		if len(gauges) != len(expected) {
+			t.Fatalf("%s: expected %d series, got %v", mode, len(expected), gauges)
+		}
+		for _, m := range gauges {
+			if value, ok := expected[labelString(m)]; !ok || m.Gauge.GetValue() != value {
+				t.Errorf("%s: unexpected series %s %v", mode, labelString(m), m.Gauge.GetValue())
+			}
+		}
+		if n := len(families["latency"].GetMetric()); n != 2 {
+			t.Errorf("%s: expected summaries to be left apart, got %d", mode, n)
+		}
+	}
+}
+
+func TestReferenceHistogramsPrefersFirstOnTie(t *testing.T) {
+	histogram := func(source string, bounds ...float64) *io_prometheus_client.Metric {
+		h := &io_prometheus_client.Histogram{}
+		for _, bound := range bounds {
+			h.Bucket = append(h.Bucket, &io_prometheus_client.Bucket{UpperBound: proto.Float64(bound)})
+		}
+		return &io_prometheus_client.Metric{
+			Label:     []*io_prometheus_client.LabelPair{{Name: proto.String("ae_source"), Value: proto.String(source)}},
+			Histogram: h,
+		}
+	}
+	mf := &io_prometheus_client.MetricFamily{
+		Type:   io_prometheus_client.MetricType_HISTOGRAM.Enum(),
+		Metric: []*io_prometheus_client.Metric{histogram("a", 1, 2), histogram("b", 5)},
+	}
+
+	if reference := referenceHistograms(mf, "ae_source")[""]; reference != mf.Metric[0].Histogram {
+		t.Errorf("expected the buckets of the first target to win a tie, got %v", reference)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// maxTargetListBytes limits how much of a -targets.url response is read.
+const maxTargetListBytes = 4 << 20
+
+// targetEndpoint discovers targets by fetching -targets.url, which returns
+// either one target URL per line or a JSON array of them. The URLs of the
+// last successful fetch are kept when it fails.
+type targetEndpoint struct {
+	url    string
+	client *http.Client
+
+	discoveredTargets
+}
+
+func (e *targetEndpoint) run() (bool, error) {
+	res, err := e.client.Get(e.url)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxTargetListBytes))
+	if err != nil {
+		return false, err
+	}
+	if res.StatusCode/100 != 2 {
+		return false, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	var urls []string
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") || bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		if err := json.Unmarshal(body, &urls); err != nil {
+			return false, fmt.Errorf("invalid JSON target list: %s", err.Error())
+		}
+		for i := range urls {
+			urls[i] = strings.TrimSpace(urls[i])
+		}
+	} else if urls, err = readTargetList(bytes.NewReader(body)); err != nil {
+		return false, err
+	}
+	return e.set(urls)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTargetEndpoint(t *testing.T) {
+	var contentType, body string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", contentType)
+		rw.WriteHeader(status)
+		io.WriteString(rw, body)
+	}))
+	defer server.Close()
+
+	endpoint := &targetEndpoint{url: server.URL, client: &http.Client{Timeout: time.Second}}
+	r := &reloader{config: &Config{}, aggregator: &Aggregator{HTTP: &http.Client{Timeout: time.Second}}, targetURLs: []string{"http://c/metrics"}, sources: []targetSource{endpoint}}
+
+	contentType, body = "text/plain", "http://a/metrics\n\nhttp://b/metrics\n"
+	if changed, err := endpoint.run(); err != nil || !changed {
+		t.Fatalf("expected the first fetch to change the targets, got %v and error %v", changed, err)
+	}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(r.config.currentTargets()); n != 3 {
+		t.Errorf("expected the 2 fetched targets and the fixed one, got %d", n)
+	}
+
+	contentType, body = "application/json", `["http://a/metrics", "http://b/metrics"]`
+	if changed, err := endpoint.run(); err != nil || changed {
+		t.Errorf("expected the same targets as JSON to be unchanged, got %v and error %v", changed, err)
+	}
+
+	for name, response := range map[string]struct {
+		status      int
+		contentType string
+		body        string
+	}{
+		"error status": {http.StatusInternalServerError, "text/plain", "http://d/metrics"},
+		"invalid json": {http.StatusOK, "application/json", `{"targets": []}`},
+		"empty":        {http.StatusOK, "text/plain", "\n"},
+		"invalid url":  {http.StatusOK, "text/plain", "not-a-url"},
+	} {
+		status, contentType, body = response.status, response.contentType, response.body
+		if _, err := endpoint.run(); err == nil {
+			t.Errorf("expected %s to fail", name)
+		}
+	}
+	if urls := endpoint.current(); len(urls) != 2 || urls[0] != "http://a/metrics" || urls[1] != "http://b/metrics" {
+		t.Errorf("expected the last successful targets to be kept, got %v", urls)
+	}
+}
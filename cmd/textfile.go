@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// fileWriter writes the aggregated metrics in the text format to -output.file
+// every -output.file.interval, e.g. for the textfile collector of
+// node_exporter. Every write goes to a temporary file in the same directory
+// that is then renamed over the file, so readers never see it half written.
+type fileWriter struct {
+	config     *Config
+	aggregator *Aggregator
+	path       string
+}
+
+func (w *fileWriter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := w.write(); err != nil {
+			outputFileFailures.Inc()
+			log.Printf("Writing metrics to %s failed: %s", w.path, err.Error())
+		}
+		<-ticker.C
+	}
+}
+
+func (w *fileWriter) write() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(w.path), "."+filepath.Base(w.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := w.aggregator.Aggregate(w.config.currentTargets(), tmp, AggregateOptions{Format: expfmt.FmtText}); err != nil {
+		tmp.Close()
+		return err
+	}
+	// Temporary files are only readable by their owner.
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), w.path)
+}
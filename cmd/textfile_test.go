@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileWriter(t *testing.T) {
+	server := newFixtureServer("histogram.txt")
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "aggregate-exporter-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "aggregate.prom")
+	if err := ioutil.WriteFile(path, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &fileWriter{
+		config:     &Config{Targets: []*Target{{URL: server.URL}}},
+		aggregator: &Aggregator{HTTP: &http.Client{Timeout: time.Second}},
+		path:       path,
+	}
+	if err := w.write(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	families, err := getMetricFamilies(f)
+	if err != nil {
+		t.Fatalf("expected the file to be replaced with the metrics, got %s", err.Error())
+	}
+	if len(families["http_requests_total"].GetMetric()) != 2 {
+		t.Errorf("expected the metrics of the target, got %v", families)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("expected the file to be readable by everyone, got %v and error %v", info.Mode(), err)
+	}
+	if entries, err := ioutil.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("expected no temporary files to be left, got %d files and error %v", len(entries), err)
+	}
+}
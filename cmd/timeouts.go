@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// adaptiveTimeouts gives targets that time out more time on their next
+// scrapes for -targets.scrape.timeout.max. Each timeout doubles the timeout of
+// the target up to the maximum and each successful scrape halves it again
+// until it is back at -targets.scrape.timeout.
+type adaptiveTimeouts struct {
+	mu       sync.Mutex
+	timeouts map[*Target]time.Duration
+}
+
+// timeout returns the timeout for the next scrape of target, base unless it
+// has been raised.
+func (a *adaptiveTimeouts) timeout(target *Target, base time.Duration) time.Duration {
+	if *targetScrapeTimeoutMax <= 0 {
+		return base
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if timeout, ok := a.timeouts[target]; ok {
+		return timeout
+	}
+	return base
+}
+
+// retarget moves the timeouts of the targets in moved to those replacing them
+// after a reload and forgets targets that were removed.
+func (a *adaptiveTimeouts) retarget(moved map[*Target]*Target) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	timeouts := make(map[*Target]time.Duration, len(a.timeouts))
+	for target, timeout := range a.timeouts {
+		if replacement, ok := moved[target]; ok {
+			timeouts[replacement] = timeout
+		}
+	}
+	a.timeouts = timeouts
+}
+
+// record raises or lowers the timeout of target after result.
+func (a *adaptiveTimeouts) record(target *Target, base time.Duration, result *Result) {
+	if *targetScrapeTimeoutMax <= 0 || base <= 0 {
+		return
+	}
+	max := time.Duration(*targetScrapeTimeoutMax) * time.Millisecond
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	current, ok := a.timeouts[target]
+	if !ok {
+		current = base
+	}
+	switch {
+	case result.ErrorCategory == errorTimeout && current < max:
+		raised := current * 2
+		if raised > max {
+			raised = max
+		}
+		if a.timeouts == nil {
+			a.timeouts = make(map[*Target]time.Duration)
+		}
+		a.timeouts[target] = raised
+		if *verboseFlag {
+			log.Printf("Raised the timeout of %s to %s", target.URL, raised)
+		}
+	case result.Error == nil && ok:
+		if lowered := current / 2; lowered > base {
+			a.timeouts[target] = lowered
+		} else {
+			delete(a.timeouts, target)
+		}
+	}
+}
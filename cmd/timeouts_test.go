@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveTimeouts(t *testing.T) {
+	defer func(max int) { *targetScrapeTimeoutMax = max }(*targetScrapeTimeoutMax)
+	*targetScrapeTimeoutMax = 500
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+		io.WriteString(rw, "up 1\n")
+	}))
+	defer server.Close()
+
+	target := &Target{URL: server.URL}
+	base := 100 * time.Millisecond
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: base}}
+	resultChan := make(chan *Result, 1)
+
+	aggregator.fetch(context.Background(), target, resultChan)
+	if result := <-resultChan; result.ErrorCategory != errorTimeout {
+		t.Fatalf("expected the first scrape to time out, got %v", result.Error)
+	}
+	if timeout := aggregator.timeouts.timeout(target, base); timeout != 2*base {
+		t.Fatalf("expected the timeout to be doubled, got %s", timeout)
+	}
+
+	aggregator.fetch(context.Background(), target, resultChan)
+	if result := <-resultChan; result.Error != nil {
+		t.Fatalf("expected the scrape with the raised timeout to succeed, got %s", result.Error)
+	}
+	if timeout := aggregator.timeouts.timeout(target, base); timeout != base {
+		t.Errorf("expected the timeout to decay after a success, got %s", timeout)
+	}
+
+	for i := 0; i < 5; i++ {
+		aggregator.timeouts.record(target, base, &Result{ErrorCategory: errorTimeout})
+	}
+	if timeout := aggregator.timeouts.timeout(target, base); timeout != 500*time.Millisecond {
+		t.Errorf("expected the timeout to be capped at -targets.scrape.timeout.max, got %s", timeout)
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_model/go"
+)
+
+// setTimestamps sets the timestamp of every metric in families to t for
+// -output.timestamp, replacing any timestamp sent by the targets. Results
+// cached by background scrapes then look as fresh as the aggregation instead
+// of as old as their scrape.
+func setTimestamps(families map[string]*io_prometheus_client.MetricFamily, t time.Time) {
+	ms := t.UnixNano() / int64(time.Millisecond)
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			m.TimestampMs = &ms
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputTimestamp(t *testing.T) {
+	defer func(enabled bool) { *outputTimestamp = enabled }(*outputTimestamp)
+	*outputTimestamp = true
+
+	server := newFixtureServer("histogram.txt")
+	defer server.Close()
+
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	output := &bytes.Buffer{}
+	(&Aggregator{HTTP: &http.Client{Timeout: time.Second}}).Aggregate([]*Target{{URL: server.URL}}, output, AggregateOptions{})
+	after := time.Now().UnixNano() / int64(time.Millisecond)
+
+	samples := 0
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		samples++
+		fields := strings.Fields(line)
+		ts, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+		if err != nil || ts < before || ts > after {
+			t.Errorf("expected the aggregation time as timestamp, got %s", line)
+		}
+	}
+	if samples != 2 {
+		t.Errorf("expected 2 samples, got %d:\n%s", samples, output.String())
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the TLS configuration used to scrape targets from the
+// -targets.tls.* and -insecure-skip-verify flags.
+func newTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+
+	// enable InsecureSkipVerify
+	if *insecureSkipVerifyFlag {
+		log.Printf("disabled verification of TLS certificates")
+		config.InsecureSkipVerify = true
+	}
+
+	var err error
+	if config.MinVersion, err = parseTLSVersion(*targetTLSMinVersion); err != nil {
+		return nil, fmt.Errorf("invalid targets.tls.min-version: %s", err.Error())
+	}
+	if config.MaxVersion, err = parseTLSVersion(*targetTLSMaxVersion); err != nil {
+		return nil, fmt.Errorf("invalid targets.tls.max-version: %s", err.Error())
+	}
+	if config.MinVersion != 0 && config.MaxVersion != 0 && config.MinVersion > config.MaxVersion {
+		return nil, fmt.Errorf("targets.tls.min-version %s is above targets.tls.max-version %s", *targetTLSMinVersion, *targetTLSMaxVersion)
+	}
+	if config.CipherSuites, err = parseCipherSuites(*targetTLSCipherSuites); err != nil {
+		return nil, fmt.Errorf("invalid targets.tls.cipher-suites: %s", err.Error())
+	}
+	return config, nil
+}
+
+// parseTLSVersion parses versions such as "1.2". An empty string gives 0 so
+// the crypto/tls default is used.
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	if v, ok := tlsVersions[version]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q, must be one of 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// parseCipherSuites parses a comma separated list of cipher suite names as
+// given by crypto/tls e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Note the
+// list only applies to TLS 1.2 and below, TLS 1.3 suites are not configurable
+// so naming one is an error rather than silently having no effect. Insecure
+// suites are allowed, for old targets, but logged.
+func parseCipherSuites(names string) ([]uint16, error) {
+	known := map[string]*tls.CipherSuite{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite
+	}
+
+	var ids []uint16
+	for _, name := range filterEmptyStrings(strings.Split(names, ",")) {
+		name = strings.TrimSpace(name)
+		suite, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if !beforeTLS13(suite) {
+			return nil, fmt.Errorf("cipher suite %q is only used by TLS 1.3, whose cipher suites cannot be configured, so it would have no effect", name)
+		}
+		if suite.Insecure {
+			log.Printf("WARNING: cipher suite %s is insecure", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// beforeTLS13 reports whether suite can be used by a TLS version before 1.3.
+func beforeTLS13(suite *tls.CipherSuite) bool {
+	for _, version := range suite.SupportedVersions {
+		if version < tls.VersionTLS13 {
+			return true
+		}
+	}
+	return false
+}
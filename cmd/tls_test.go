@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	defer func(min, max, ciphers string) {
+		*targetTLSMinVersion, *targetTLSMaxVersion, *targetTLSCipherSuites = min, max, ciphers
+	}(*targetTLSMinVersion, *targetTLSMaxVersion, *targetTLSCipherSuites)
+
+	*targetTLSMinVersion, *targetTLSMaxVersion = "1.2", "1.3"
+	*targetTLSCipherSuites = "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"
+	config, err := newTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || config.MaxVersion != tls.VersionTLS13 {
+		t.Errorf("unexpected TLS versions %x-%x", config.MinVersion, config.MaxVersion)
+	}
+	if len(config.CipherSuites) != 2 || config.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("unexpected cipher suites %v", config.CipherSuites)
+	}
+
+	for _, invalid := range [][3]string{
+		{"1.4", "", ""},
+		{"", "TLS12", ""},
+		{"1.3", "1.2", ""},
+		{"", "", "TLS_NOT_A_CIPHER"},
+		{"", "", "TLS_AES_128_GCM_SHA256"},
+	} {
+		*targetTLSMinVersion, *targetTLSMaxVersion, *targetTLSCipherSuites = invalid[0], invalid[1], invalid[2]
+		if _, err := newTLSConfig(); err == nil {
+			t.Errorf("expected an error for %v", invalid)
+		}
+	}
+}
+
+func TestParseCipherSuitesInsecure(t *testing.T) {
+	logs := &bytes.Buffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	ids, err := parseCipherSuites("TLS_RSA_WITH_RC4_128_SHA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != tls.TLS_RSA_WITH_RC4_128_SHA {
+		t.Errorf("unexpected cipher suites %v", ids)
+	}
+	if !strings.Contains(logs.String(), "WARNING: cipher suite TLS_RSA_WITH_RC4_128_SHA is insecure") {
+		t.Errorf("expected a warning for an insecure cipher suite, got %q", logs.String())
+	}
+}
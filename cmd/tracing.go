@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of requests and fetches. Until setupTracing is
+// called it is the no-op tracer of the global provider.
+var tracer = otel.Tracer("github.com/warmans/prometheus-aggregate-exporter")
+
+// setupTracing exports spans over OTLP/HTTP for -tracing.enabled. The
+// endpoint, headers and service name are taken from the standard
+// OTEL_EXPORTER_OTLP_* and OTEL_SERVICE_NAME environment variables.
+func setupTracing(ctx context.Context) error {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return err
+	}
+	res, err := resource.New(
+		ctx,
+		resource.WithAttributes(attribute.String("service.name", "prometheus-aggregate-exporter")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)))
+	return nil
+}
+
+// endFetchSpan records the outcome of result on the span of its fetch.
+func endFetchSpan(span trace.Span, result *Result) {
+	span.SetAttributes(
+		attribute.Float64("scrape.duration_seconds", result.SecondsTaken),
+		attribute.Int("http.response.status_code", result.StatusCode),
+		attribute.Bool("scrape.stale", result.Stale),
+		attribute.Bool("scrape.partial", result.Partial),
+	)
+	if result.Error != nil {
+		span.SetAttributes(attribute.String("scrape.error_category", result.ErrorCategory))
+		span.SetStatus(codes.Error, result.Error.Error())
+	}
+	span.End()
+}
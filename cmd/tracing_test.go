@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMetricsHandlerTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	up, down := newFixtureServer("histogram.txt"), newFixtureServer("histogram.txt")
+	defer up.Close()
+	down.Close()
+
+	config := &Config{Targets: []*Target{{URL: up.URL}, {URL: down.URL}}}
+	metricsHandler(config, &Aggregator{HTTP: &http.Client{Timeout: time.Second}})(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected a span for the request and each fetch, got %d", len(spans))
+	}
+	request := spans[len(spans)-1]
+	if request.Name() != "GET /metrics" {
+		t.Fatalf("expected the request span to end last, got %s", request.Name())
+	}
+	failed := map[attribute.Value]bool{}
+	for _, span := range spans[:2] {
+		if span.Name() != "fetch" || span.Parent().SpanID() != request.SpanContext().SpanID() {
+			t.Errorf("expected %s to be a fetch under the request span", span.Name())
+		}
+		for _, a := range span.Attributes() {
+			if a.Key == "url.full" {
+				failed[a.Value] = span.Status().Code == codes.Error
+			}
+		}
+	}
+	if failed[attribute.StringValue(up.URL)] || !failed[attribute.StringValue(down.URL)] {
+		t.Errorf("expected only the fetch of %s to have failed, got %v", down.URL, failed)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// newTransport creates the transport used to scrape targets. Unlike
+// http.DefaultTransport the dial, TLS handshake and response header phases
+// can each be given their own timeout so a target that is slow to connect
+// can be told apart from one that is slow to send its metrics.
+func newTransport() (*http.Transport, error) {
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(*targetDialTimeout) * time.Millisecond,
+		KeepAlive: *targetKeepAlive,
+	}
+	transport := &http.Transport{
+		Proxy:                  http.ProxyFromEnvironment,
+		DialContext:            dialer.DialContext,
+		ForceAttemptHTTP2:      true,
+		MaxIdleConns:           100,
+		IdleConnTimeout:        90 * time.Second,
+		ExpectContinueTimeout:  1 * time.Second,
+		TLSHandshakeTimeout:    time.Duration(*targetTLSHandshakeTimeout) * time.Millisecond,
+		ResponseHeaderTimeout:  time.Duration(*targetResponseHeaderTimeout) * time.Millisecond,
+		MaxResponseHeaderBytes: int64(*targetResponseHeaderMax),
+		TLSClientConfig:        tlsConfig,
+	}
+	if *targetBlockPrivate {
+		dialer.Control = refusePrivateAddress
+		transport.Proxy = refuseProxiedPrivateTargets(transport.Proxy)
+	}
+
+	transport.RegisterProtocol("grpc", newGRPCRoundTripper(transport, false))
+	transport.RegisterProtocol("grpcs", newGRPCRoundTripper(transport, true))
+
+	return transport, nil
+}
+
+// clientFor returns the client used to scrape target.
+func (f *Aggregator) clientFor(target *Target) *http.Client {
+	if target.SSH != nil {
+		return f.ssh.client(f.HTTP, *target.SSH)
+	}
+	if target.DisableKeepAlive {
+		return f.noKeepAliveClient()
+	}
+	if !target.H2C {
+		return f.HTTP
+	}
+	f.h2cOnce.Do(func() {
+		base, ok := f.HTTP.Transport.(*http.Transport)
+		if !ok {
+			base = http.DefaultTransport.(*http.Transport)
+		}
+		transport := base.Clone()
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+
+		client := *f.HTTP
+		client.Transport = transport
+		f.h2c = &client
+	})
+	return f.h2c
+}
+
+// noKeepAliveClient returns the client for targets with disable_keepalive. It
+// only speaks HTTP/1.1 and opens a new connection for every request, sending
+// Connection: close, which is as close to HTTP/1.0 as the client gets.
+func (f *Aggregator) noKeepAliveClient() *http.Client {
+	f.noKeepAliveOnce.Do(func() {
+		base, ok := f.HTTP.Transport.(*http.Transport)
+		if !ok {
+			base = http.DefaultTransport.(*http.Transport)
+		}
+		transport := base.Clone()
+		transport.DisableKeepAlives = true
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP1(true)
+
+		client := *f.HTTP
+		client.Transport = transport
+		f.noKeepAlive = &client
+	})
+	return f.noKeepAlive
+}
+
+// errPrivateAddress is returned when -targets.block-private refuses to connect
+// to a target.
+var errPrivateAddress = errors.New("refusing to connect to a private, loopback or link-local address")
+
+// refusePrivateAddress is a net.Dialer Control function for
+// -targets.block-private. It checks the address a connection is actually made
+// to, after the name of the target has been resolved, so a name that resolves
+// to an internal address cannot get around it.
+func refusePrivateAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if isPrivateIP(net.ParseIP(host)) {
+		return fmt.Errorf("%s: %w", address, errPrivateAddress)
+	}
+	return nil
+}
+
+// refuseProxiedPrivateTargets wraps the Proxy function of the transport for
+// -targets.block-private. When a request goes through a proxy the dialer only
+// sees the address of the proxy, so the name of the target is resolved and
+// checked here instead.
+func refuseProxiedPrivateTargets(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxy(req)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(req.Context(), req.URL.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if isPrivateIP(addr.IP) {
+				return nil, fmt.Errorf("%s resolves to %s: %w", req.URL.Host, addr.IP, errPrivateAddress)
+			}
+		}
+		return proxyURL, nil
+	}
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestH2CTarget(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "# TYPE proto_major gauge\n")
+		io.WriteString(rw, "proto_major "+r.Proto[len("HTTP/"):len("HTTP/")+1]+"\n")
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second, Transport: mustNewTransport()}}
+	for h2c, expected := range map[bool]float64{false: 1, true: 2} {
+		target := &Target{URL: server.URL, H2C: h2c}
+		result := aggregator.scrape(target, target.URL)
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		if actual := result.MetricFamily["proto_major"].Metric[0].Gauge.GetValue(); actual != expected {
+			t.Errorf("expected HTTP/%v with h2c=%v, got HTTP/%v", expected, h2c, actual)
+		}
+	}
+}
+
+func TestDisableKeepAliveTarget(t *testing.T) {
+	var connections, closing int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Close {
+			atomic.AddInt32(&closing, 1)
+		}
+		io.WriteString(rw, "up 1\n")
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	aggregator := &Aggregator{HTTP: &http.Client{Timeout: time.Second, Transport: mustNewTransport()}}
+	for disable, expected := range map[bool]int32{false: 1, true: 2} {
+		atomic.StoreInt32(&connections, 0)
+		atomic.StoreInt32(&closing, 0)
+		target := &Target{URL: server.URL, DisableKeepAlive: disable}
+		for i := 0; i < 2; i++ {
+			if result := aggregator.scrape(target, target.URL); result.Error != nil {
+				t.Fatal(result.Error)
+			}
+		}
+		if n := atomic.LoadInt32(&connections); n != expected {
+			t.Errorf("expected %d connections for 2 scrapes with disable_keepalive=%v, got %d", expected, disable, n)
+		}
+		if n := atomic.LoadInt32(&closing); disable && n != 2 || !disable && n != 0 {
+			t.Errorf("expected Connection: close only with disable_keepalive, got it on %d requests with disable_keepalive=%v", n, disable)
+		}
+	}
+}
+
+func TestBlockPrivateTargets(t *testing.T) {
+	defer func(block bool) { *targetBlockPrivate = block }(*targetBlockPrivate)
+	*targetBlockPrivate = true
+
+	server := newFixtureServer("histogram.txt")
+	defer server.Close()
+
+	target := &Target{URL: server.URL}
+	result := (&Aggregator{HTTP: &http.Client{Transport: mustNewTransport(), Timeout: time.Second}}).scrape(target, target.URL)
+	if result.Error == nil || result.ErrorCategory != errorBlocked {
+		t.Errorf("expected the loopback target to be blocked, got %v (%s)", result.Error, result.ErrorCategory)
+	}
+
+	for address, blocked := range map[string]bool{
+		"10.1.2.3:80":        true,
+		"192.168.0.1:80":     true,
+		"169.254.169.254:80": true,
+		"[::1]:80":           true,
+		"[fe80::1]:80":       true,
+		"0.0.0.0:80":         true,
+		"8.8.8.8:80":         false,
+		"[2001:db8::1]:80":   false,
+	} {
+		if err := refusePrivateAddress("tcp", address, nil); (err != nil) != blocked {
+			t.Errorf("expected %s blocked=%v, got %v", address, blocked, err)
+		}
+	}
+}
+
+func TestMaxResponseHeaderBytes(t *testing.T) {
+	defer func(max int) { *targetResponseHeaderMax = max }(*targetResponseHeaderMax)
+	*targetResponseHeaderMax = 1024
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			rw.Header().Set("X-Padding", strings.Repeat("x", 4096))
+		}
+		io.WriteString(rw, "up 1\n")
+	}))
+	defer server.Close()
+
+	aggregator := &Aggregator{HTTP: &http.Client{Transport: mustNewTransport(), Timeout: time.Second}}
+	if result := aggregator.scrape(&Target{URL: server.URL}, server.URL); result.Error != nil {
+		t.Errorf("expected small headers to be accepted, got %v", result.Error)
+	}
+	if result := aggregator.scrape(&Target{URL: server.URL + "/large"}, server.URL+"/large"); result.Error == nil {
+		t.Error("expected headers over the limit to fail the scrape")
+	}
+}
+
+func TestDialTimeoutOnlyLimitsConnecting(t *testing.T) {
+	defer func(timeout int) { *targetDialTimeout = timeout }(*targetDialTimeout)
+	*targetDialTimeout = 20
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(rw, "up 1\n")
+	}))
+	defer server.Close()
+
+	target := &Target{URL: server.URL}
+	result := (&Aggregator{HTTP: &http.Client{Transport: mustNewTransport(), Timeout: time.Second}}).scrape(target, target.URL)
+	if result.Error != nil {
+		t.Errorf("expected a slow response over a fast connection to be scraped, got %v", result.Error)
+	}
+}
+
+func TestBlockPrivateProxiedTargets(t *testing.T) {
+	proxyURL, _ := url.Parse("http://proxy.example.com:3128")
+	proxy := refuseProxiedPrivateTargets(http.ProxyURL(proxyURL))
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1:9100/metrics", nil)
+	if _, err := proxy(req); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("expected a proxied loopback target to be blocked, got %v", err)
+	}
+	req = httptest.NewRequest("GET", "http://8.8.8.8:9100/metrics", nil)
+	if u, err := proxy(req); err != nil || u != proxyURL {
+		t.Errorf("expected a public target to go through the proxy, got %v and error %v", u, err)
+	}
+
+	direct := refuseProxiedPrivateTargets(func(*http.Request) (*url.URL, error) { return nil, nil })
+	if u, err := direct(httptest.NewRequest("GET", "http://127.0.0.1:9100/metrics", nil)); u != nil || err != nil {
+		t.Errorf("expected requests without a proxy to be left to the dialer, got %v and error %v", u, err)
+	}
+}
+
+func TestBlockPrivateRejectsSSHTargets(t *testing.T) {
+	defer func(block bool) { *targetBlockPrivate = block }(*targetBlockPrivate)
+	*targetBlockPrivate = true
+
+	path := writeConfigFile(t, `{"targets": [{"url": "http://10.1.0.5/metrics", "ssh": {"host": "bastion:22", "user": "u", "key_file": "id_ed25519"}}]}`)
+	defer os.Remove(path)
+	if _, err := loadConfigFile(path); err == nil {
+		t.Error("expected ssh targets to be rejected with -targets.block-private")
+	}
+}
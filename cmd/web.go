@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clientIP returns the address of the client that sent r. Behind a reverse
+// proxy that is taken from the -web.proxy-header, since the remote address is
+// the proxy's. Only the addresses appended by trusted proxies can be relied
+// on, so X-Forwarded-For is read from the right: the right-most address that
+// is not one of the -web.proxy-trusted proxies is the client, and without any
+// the right-most address, added by the proxy that sent r. With
+// -web.proxy-trusted the header is ignored on requests from other addresses.
+func clientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if *webProxyHeader == "" {
+		return remote
+	}
+	forwarded := r.Header.Get(*webProxyHeader)
+	if forwarded == "" {
+		return remote
+	}
+	trusted, _ := parseTrustedProxies(*webProxyTrusted)
+	if len(trusted) > 0 && !containsIP(trusted, remote) {
+		return remote
+	}
+	addresses := strings.Split(forwarded, ",")
+	for i := len(addresses) - 1; i > 0; i-- {
+		if address := strings.TrimSpace(addresses[i]); !containsIP(trusted, address) {
+			return address
+		}
+	}
+	return strings.TrimSpace(addresses[0])
+}
+
+// parseTrustedProxies parses -web.proxy-trusted, a comma separated list of
+// addresses and CIDR ranges.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, entry := range filterEmptyStrings(strings.Split(list, ",")) {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an address or CIDR range", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an address or CIDR range", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// stallWriter fails writes to a client that has not accepted any data for
+// -web.write-stall-timeout. Otherwise a client that stops reading holds the
+// encoded metrics in memory until -web.write-timeout, if there is one.
+type stallWriter struct {
+	controller *http.ResponseController
+	writer     io.Writer
+	timeout    time.Duration
+	// deadline is the -web.write-timeout of the response which the stall
+	// timeout must not extend.
+	deadline time.Time
+	stalled  bool
+}
+
+func newStallWriter(rw http.ResponseWriter, timeout time.Duration) *stallWriter {
+	w := &stallWriter{controller: http.NewResponseController(rw), writer: rw, timeout: timeout}
+	if *webWriteTimeout > 0 {
+		w.deadline = time.Now().Add(*webWriteTimeout)
+	}
+	return w
+}
+
+func (w *stallWriter) Write(p []byte) (int, error) {
+	deadline := time.Now().Add(w.timeout)
+	if !w.deadline.IsZero() && w.deadline.Before(deadline) {
+		deadline = w.deadline
+	}
+	// Writers that do not support deadlines, e.g. in tests, are written to
+	// without one.
+	w.controller.SetWriteDeadline(deadline)
+	n, err := w.writer.Write(p)
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		w.stalled = true
+	}
+	return n, err
+}
+
+// logRequests logs every request handled by next in -verbose mode.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !*verboseFlag {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		startTime := time.Now()
+		recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		log.Printf("%s %s %s from %s in %.3f seconds", r.Method, r.URL.RequestURI(), http.StatusText(recorder.status), clientIP(r), time.Since(startTime).Seconds())
+	})
+}
+
+// limitRequests returns a wrapper for -web.max.concurrent.requests that
+// rejects requests with 503 while max requests are already being handled by
+// any of the handlers it wraps, so a burst of scrapes does not start more
+// aggregations than the exporter and the targets can take. Every handler that
+// scrapes targets is wrapped by the same limiter so they share the limit.
+// Retry-After asks clients to come back once a running aggregation should be
+// done. A max of 0 means no limit.
+func limitRequests(max int) func(next http.HandlerFunc) http.HandlerFunc {
+	if max <= 0 {
+		return func(next http.HandlerFunc) http.HandlerFunc { return next }
+	}
+	slots := make(chan struct{}, max)
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(rw http.ResponseWriter, r *http.Request) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+				next.ServeHTTP(rw, r)
+			default:
+				requestsRejected.Inc()
+				retryAfter := (*targetScrapeTimeout + 999) / 1000
+				if retryAfter < 1 {
+					retryAfter = 1
+				}
+				rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				http.Error(rw, "Too many concurrent requests", http.StatusServiceUnavailable)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func(header, trusted string) { *webProxyHeader, *webProxyTrusted = header, trusted }(*webProxyHeader, *webProxyTrusted)
+
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.RemoteAddr = "10.0.0.1:51234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 192.0.2.7, 10.0.0.2")
+
+	if ip := clientIP(r); ip != "10.0.0.1" {
+		t.Errorf("expected the remote address without -web.proxy-header, got %s", ip)
+	}
+	*webProxyHeader = "X-Forwarded-For"
+	if ip := clientIP(r); ip != "10.0.0.2" {
+		t.Errorf("expected the address added by the proxy sending the request, got %s", ip)
+	}
+	*webProxyTrusted = "10.0.0.0/8, 203.0.113.5"
+	if ip := clientIP(r); ip != "192.0.2.7" {
+		t.Errorf("expected the right-most address that is not a trusted proxy rather than the one the client sent, got %s", ip)
+	}
+	r.RemoteAddr = "192.0.2.99:51234"
+	if ip := clientIP(r); ip != "192.0.2.99" {
+		t.Errorf("expected the header to be ignored from an untrusted address, got %s", ip)
+	}
+	r.RemoteAddr = "203.0.113.5:51234"
+	r.Header.Del("X-Forwarded-For")
+	if ip := clientIP(r); ip != "203.0.113.5" {
+		t.Errorf("expected the remote address when the header is missing, got %s", ip)
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("expected an invalid CIDR range to be rejected")
+	}
+}
+
+func TestLimitRequests(t *testing.T) {
+	defer func(timeout int) { *targetScrapeTimeout = timeout }(*targetScrapeTimeout)
+	*targetScrapeTimeout = 2500
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	limit := limitRequests(1)
+	handler := limit(func(rw http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	other := limit(func(rw http.ResponseWriter, r *http.Request) {})
+
+	done := make(chan struct{})
+	go func() {
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+		close(done)
+	}()
+	<-started
+
+	rejectedBefore := gatherSelfMetric(t, "ae_requests_rejected_total").Metric[0].Counter.GetValue()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 beyond the limit, got %d", rec.Code)
+	}
+	if retryAfter := rec.Header().Get("Retry-After"); retryAfter != "3" {
+		t.Errorf("expected Retry-After to be the scrape timeout rounded up, got %q", retryAfter)
+	}
+	if rejected := gatherSelfMetric(t, "ae_requests_rejected_total").Metric[0].Counter.GetValue(); rejected != rejectedBefore+1 {
+		t.Errorf("expected the rejection to be counted, got %v", rejected-rejectedBefore)
+	}
+	rec = httptest.NewRecorder()
+	other(rec, httptest.NewRequest("GET", "/metrics.pb", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the limit to be shared by every wrapped handler, got %d", rec.Code)
+	}
+
+	close(release)
+	<-done
+	go func() { <-started }()
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected a request to be served once the slot is free, got %d", rec.Code)
+	}
+}